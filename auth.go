@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/adutchak/recognizer/pkg/auth"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/gorilla/mux"
+)
+
+// routeScopes are the scopes needed by the routes starting with the path, other routes need the admin scope
+var routeScopes = []struct {
+	path  string
+	scope string
+}{
+	{"/v1/recognize", auth.ScopeRecognize},
+	{"/v1/jobs/", auth.ScopeRecognize},
+	{"/v1/people", auth.ScopeEnroll},
+	{"/v1/captures", auth.ScopeEnroll},
+	{"/v1/visitors", auth.ScopeEnroll},
+}
+
+// authenticate lets the request through when the presented API key has the scope of the route,
+// the key is presented as a bearer token or in the X-Api-Key header
+func (r *recognizer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keys := r.configuration.CompiledApiKeys
+		if !keys.Enabled() {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		log := logging.WithContext(context.Background())
+		key, ok := keys.Authenticate(presentedKey(request))
+		if !ok {
+			log.Warnf("Rejected unauthenticated API request %s %s from %s", request.Method, request.URL.Path, request.RemoteAddr)
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="recognizer"`)
+			respondWithError(writer, http.StatusUnauthorized, "a valid API key is required")
+			return
+		}
+		scope := requiredScope(request)
+		if !key.Allows(scope) {
+			log.Warnf("Rejected API request %s %s, API key %s has no %s scope", request.Method, request.URL.Path, key.Name, scope)
+			respondWithError(writer, http.StatusForbidden, "the API key has no "+scope+" scope")
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func presentedKey(request *http.Request) string {
+	if key := request.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func requiredScope(request *http.Request) string {
+	path := request.URL.Path
+	if route := mux.CurrentRoute(request); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			path = template
+		}
+	}
+	for _, routeScope := range routeScopes {
+		if strings.HasPrefix(path, routeScope.path) {
+			return routeScope.scope
+		}
+	}
+	return auth.ScopeAdmin
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/adutchak/recognizer/pkg/capturestore"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/samplestore"
+)
+
+var (
+	// errAmbiguousFace is returned when the face to enroll is not specified and the capture has several unknown faces
+	errAmbiguousFace = errors.New("the capture has several unknown faces, the face has to be specified")
+	errInvalidSample = errors.New("invalid sample")
+)
+
+type enrollRequest struct {
+	Person string `json:"person"`
+	// Face is the index of the face to enroll, the only unknown face is taken when not specified
+	Face *int `json:"face"`
+}
+
+type capturesResponse struct {
+	Captures []capturestore.Capture `json:"captures"`
+}
+
+// saveCapture keeps the snapshot with the crops of the faces, so that the visitor can be enrolled later
+func (r *recognizer) saveCapture(ctx context.Context, snapshot []byte, faces []*faceComparison, results []faceResult) {
+	log := logging.WithContext(ctx)
+	if r.captureStore == nil {
+		return
+	}
+	captured := make([]capturestore.Face, 0, len(faces))
+	for i, face := range faces {
+		captured = append(captured, capturestore.Face{
+			Index:       results[i].Index,
+			BoundingBox: results[i].BoundingBox,
+			Status:      results[i].Status,
+			Content:     face.image.Bytes,
+		})
+	}
+	capture, err := r.captureStore.Save(r.configuration.RunMode, snapshot, captured)
+	if err != nil {
+		log.Errorf("Cannot save the capture: %v", err)
+		return
+	}
+	log.Infof("Saved capture %s", capture.Id)
+}
+
+// enrollCapture adds the face of the capture to the samples of the person, the person is created when missing.
+// The report is returned when the face was validated
+func (r *recognizer) enrollCapture(ctx context.Context, id string, person string, face int) (samplestore.Sample, *sampleReport, error) {
+	log := logging.WithContext(ctx)
+	capture, err := r.captureStore.Get(id)
+	if err != nil {
+		return samplestore.Sample{}, nil, err
+	}
+	if face < 0 {
+		if face, err = unknownFace(capture); err != nil {
+			return samplestore.Sample{}, nil, err
+		}
+	}
+	path, err := r.captureStore.FacePath(id, face)
+	if err != nil {
+		return samplestore.Sample{}, nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return samplestore.Sample{}, nil, err
+	}
+
+	var report *sampleReport
+	if r.configuration.ValidateSamples {
+		validated := r.validateSampleBytes(ctx, path, content)
+		report = &validated
+		if !validated.valid() {
+			return samplestore.Sample{}, report, fmt.Errorf("%w: %s", errInvalidSample, strings.Join(validated.Problems, "; "))
+		}
+	}
+
+	if err := r.sampleStore.CreatePerson(person); err != nil && !errors.Is(err, samplestore.ErrExists) {
+		return samplestore.Sample{}, report, err
+	}
+	sample, err := r.sampleStore.AddSample(person, content, ".jpg")
+	if err != nil {
+		return samplestore.Sample{}, report, err
+	}
+	log.Infof("Enrolled face %d of capture %s as %s", face, id, person)
+	r.reloadAfterChange(ctx)
+	return sample, report, nil
+}
+
+// unknownFace finds the only face of the capture which was not recognized
+func unknownFace(capture capturestore.Capture) (int, error) {
+	found := -1
+	for _, face := range capture.Faces {
+		if face.Status == faceStatusKnown {
+			continue
+		}
+		if found >= 0 {
+			return 0, errAmbiguousFace
+		}
+		found = face.Index
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("capture %s has no unknown faces: %w", capture.Id, capturestore.ErrNotFound)
+	}
+	return found, nil
+}
+
+// runEnroll enrolls the capture given in the configuration and exits
+func (r *recognizer) runEnroll(ctx context.Context) {
+	log := logging.WithContext(ctx)
+	sample, _, err := r.enrollCapture(ctx, r.configuration.EnrollCapture, r.configuration.EnrollPerson, r.configuration.EnrollFace)
+	if err != nil {
+		log.Fatalf("Cannot enroll capture %s: %v", r.configuration.EnrollCapture, err)
+	}
+	log.Infof("Stored sample %s", sample.Path)
+}
+
+func (r *recognizer) ListCapturesApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireCaptureStore(writer) {
+		return
+	}
+	captures, err := r.captureStore.List()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, capturesResponse{Captures: captures})
+}
+
+func (r *recognizer) GetCaptureApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireCaptureStore(writer) {
+		return
+	}
+	capture, err := r.captureStore.Get(mux.Vars(request)["capture"])
+	if err != nil {
+		respondWithCaptureError(writer, err)
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, capture)
+}
+
+func (r *recognizer) GetCaptureSnapshotApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireCaptureStore(writer) {
+		return
+	}
+	path, err := r.captureStore.SnapshotPath(mux.Vars(request)["capture"])
+	if err != nil {
+		respondWithCaptureError(writer, err)
+		return
+	}
+	http.ServeFile(writer, request, path)
+}
+
+func (r *recognizer) GetCaptureFaceApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireCaptureStore(writer) {
+		return
+	}
+	vars := mux.Vars(request)
+	face, err := strconv.Atoi(vars["face"])
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, "invalid face index: "+vars["face"])
+		return
+	}
+	path, err := r.captureStore.FacePath(vars["capture"], face)
+	if err != nil {
+		respondWithCaptureError(writer, err)
+		return
+	}
+	http.ServeFile(writer, request, path)
+}
+
+func (r *recognizer) DeleteCaptureApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireCaptureStore(writer) {
+		return
+	}
+	if err := r.captureStore.Delete(mux.Vars(request)["capture"]); err != nil {
+		respondWithCaptureError(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (r *recognizer) EnrollCaptureApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireCaptureStore(writer) || !r.requireSampleStore(writer) {
+		return
+	}
+	var body enrollRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		respondWithError(writer, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	face := -1
+	if body.Face != nil {
+		face = *body.Face
+	}
+	sample, report, err := r.enrollCapture(ctx, mux.Vars(request)["capture"], body.Person, face)
+	if errors.Is(err, errInvalidSample) {
+		respondWithJSON(writer, http.StatusUnprocessableEntity, addSampleResponse{Report: report})
+		return
+	}
+	if err != nil {
+		respondWithCaptureError(writer, err)
+		return
+	}
+	respondWithJSON(writer, http.StatusCreated, addSampleResponse{
+		Sample: sampleResponse{Sample: sample, Loaded: r.loaded(sample.Path)},
+		Report: report,
+	})
+}
+
+func (r *recognizer) requireCaptureStore(writer http.ResponseWriter) bool {
+	if r.captureStore == nil {
+		respondWithError(writer, http.StatusConflict, "captures are kept only when the captures directory is configured")
+		return false
+	}
+	return true
+}
+
+func respondWithCaptureError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, capturestore.ErrNotFound):
+		respondWithError(writer, http.StatusNotFound, err.Error())
+	case errors.Is(err, errAmbiguousFace):
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+	default:
+		respondWithStoreError(writer, err)
+	}
+}
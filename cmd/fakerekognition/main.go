@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/adutchak/recognizer/pkg/fakerekognition"
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+func main() {
+	ctx := context.Background()
+	log := logging.WithContext(ctx)
+
+	fs := pflag.NewFlagSet("fakerekognition", pflag.ExitOnError)
+	listen := fs.String("listen", ":4566", "specifies the address to listen on")
+	fixtures := fs.String("fixtures", "", "specifies a path to the JSON fixtures file")
+	_ = fs.Parse(os.Args[1:])
+
+	server := fakerekognition.New()
+	if *fixtures != "" {
+		if err := fakerekognition.LoadFixtures(server, *fixtures); err != nil {
+			log.Fatalf("Cannot load fixtures %s: %v", *fixtures, err)
+		}
+	}
+
+	httpServer := &http.Server{
+		Addr:              *listen,
+		Handler:           server,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Infof("Starting fake Rekognition server on %s", *listen)
+	if err := httpServer.ListenAndServe(); err != nil {
+		log.Fatalf("Error starting fake Rekognition server: %v", err)
+	}
+}
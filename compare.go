@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+
+	"github.com/adutchak/recognizer/pkg/config"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/resilience"
+)
+
+type outcome int
+
+const (
+	outcomeNotRecognized outcome = iota
+	outcomeRecognized
+	outcomeTailgating
+	outcomeUnavailable
+)
+
+const (
+	faceStatusKnown        = "known"
+	faceStatusUnknown      = "unknown"
+	faceStatusUndetermined = "undetermined"
+	// faceStatusNotCompared is reported when comparisons were stopped because another face was already recognized
+	faceStatusNotCompared = "not_compared"
+)
+
+// faceResult is the comparison result of a single face reported to the caller
+type faceResult struct {
+	Index       int               `json:"index"`
+	BoundingBox types.BoundingBox `json:"boundingBox"`
+	Status      string            `json:"status"`
+	Sample      string            `json:"sample,omitempty"`
+	Person      string            `json:"person,omitempty"`
+	// Visitor is the cluster of the unknown face, when unknown visitors are tracked
+	Visitor    string  `json:"visitor,omitempty"`
+	Similarity float32 `json:"similarity,omitempty"`
+}
+
+// faceComparison tracks the comparison of a single detected face with the samples
+type faceComparison struct {
+	index int
+	box   types.BoundingBox
+	image types.Image
+	// ctx is cancelled as soon as the face matches one of the samples
+	ctx    context.Context
+	cancel context.CancelFunc
+	// failed is set when the face could not be compared with some of the samples because of AWS errors
+	failed atomic.Bool
+	// compared counts the samples the face was actually compared with, out of samples
+	compared   atomic.Int32
+	samples    int
+	matchOnce  sync.Once
+	sample     string
+	similarity float32
+}
+
+func (f *faceComparison) known() bool {
+	return f.sample != ""
+}
+
+func (f *faceComparison) result() faceResult {
+	result := faceResult{
+		Index:       f.index,
+		BoundingBox: f.box,
+		Status:      faceStatusUnknown,
+	}
+	switch {
+	case f.known():
+		result.Status = faceStatusKnown
+		result.Sample = f.sample
+		result.Similarity = f.similarity
+	case f.failed.Load():
+		result.Status = faceStatusUndetermined
+	case int(f.compared.Load()) < f.samples:
+		result.Status = faceStatusNotCompared
+	}
+	return result
+}
+
+type compareJob struct {
+	face   *faceComparison
+	sample string
+	input  rekognition.CompareFacesInput
+}
+
+// compareFaces crops every detected face with a margin and compares each crop independently with all the samples
+// using a bounded pool of workers, in order to not exceed Rekognition TPS limits
+func (r *recognizer) compareFaces(ctx context.Context, sourceBytes []byte, faceDetails []types.FaceDetail) ([]*faceComparison, error) {
+	log := logging.WithContext(ctx)
+
+	boxes := make([]types.BoundingBox, 0, len(faceDetails))
+	for _, faceDetail := range faceDetails {
+		if faceDetail.BoundingBox == nil {
+			return nil, errors.New("face without bounding box")
+		}
+		boxes = append(boxes, *faceDetail.BoundingBox)
+	}
+	// samples may be reloaded meanwhile, all the faces are compared with the same ones
+	rekognitionInputs := r.inputs()
+	crops, err := r.cropFaces(sourceBytes, boxes, r.configuration.FaceCropMargin)
+	if err != nil {
+		return nil, err
+	}
+
+	// cancel the remaining comparisons as soon as the outcome is decided
+	compareCtx, cancelCompare := context.WithCancel(ctx)
+	defer cancelCompare()
+	stopOnFirstMatch := r.configuration.MultiFacePolicy == config.MultiFacePolicyAnyKnown
+
+	faces := make([]*faceComparison, 0, len(crops))
+	for i, crop := range crops {
+		faceCtx, cancelFace := context.WithCancel(compareCtx)
+		defer cancelFace()
+		faces = append(faces, &faceComparison{
+			index:   i,
+			box:     boxes[i],
+			image:   types.Image{Bytes: crop},
+			ctx:     faceCtx,
+			cancel:  cancelFace,
+			samples: len(rekognitionInputs),
+		})
+	}
+
+	jobs := make(chan compareJob)
+	var wg sync.WaitGroup
+	workers := r.configuration.CompareFacesParallelism
+	if workers > len(faces)*len(rekognitionInputs) {
+		workers = len(faces) * len(rekognitionInputs)
+	}
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				face := job.face
+				// the face was already recognized
+				if face.ctx.Err() != nil {
+					continue
+				}
+				input := job.input
+				input.SourceImage = &face.image
+
+				var output *rekognition.CompareFacesOutput
+				err := r.callRekognition(face.ctx, func(ctx context.Context) (err error) {
+					output, err = r.recognizeClient.CompareFaces(ctx, &input)
+					return err
+				})
+				// comparison was cancelled because a match was already found
+				if err != nil && face.ctx.Err() != nil {
+					continue
+				}
+				face.compared.Add(1)
+				if err != nil {
+					log.Errorf("Error comparing face %d with %s: %v", face.index, job.sample, err)
+					if resilience.IsTransient(err) || errors.Is(err, resilience.ErrCircuitOpen) {
+						face.failed.Store(true)
+					}
+					continue
+				}
+
+				if len(output.FaceMatches) == 0 {
+					log.Warnf("Did not recognize face %d as %s", face.index, job.sample)
+					continue
+				}
+				face.matchOnce.Do(func() {
+					face.sample = job.sample
+					face.similarity = aws.ToFloat32(output.FaceMatches[0].Similarity)
+					face.cancel()
+					log.Infof("recognized face %d as %s (similarity %f)", face.index, job.sample, face.similarity)
+					if stopOnFirstMatch {
+						cancelCompare()
+					}
+				})
+			}
+		}()
+	}
+
+feed:
+	for _, face := range faces {
+		for _, rekognitionInput := range rekognitionInputs {
+			for sample, input := range rekognitionInput {
+				select {
+				case jobs <- compareJob{face: face, sample: sample, input: input}:
+				case <-compareCtx.Done():
+					break feed
+				}
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return faces, nil
+}
+
+// reportFaces logs the result of every face and returns the results in the order of detection
+func (r *recognizer) reportFaces(ctx context.Context, faces []*faceComparison) []faceResult {
+	log := logging.WithContext(ctx)
+	results := make([]faceResult, 0, len(faces))
+	for _, face := range faces {
+		result := face.result()
+		switch result.Status {
+		case faceStatusKnown:
+			result.Person = r.personOf(result.Sample)
+			log.Infof("Face %d: recognized as %s from %s (similarity %f)", result.Index, result.Person, result.Sample, result.Similarity)
+		case faceStatusUndetermined:
+			log.Warnf("Face %d: could not be compared with all the samples", result.Index)
+		case faceStatusNotCompared:
+			log.Infof("Face %d: not compared, another face was recognized", result.Index)
+		default:
+			log.Infof("Face %d: not recognized", result.Index)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// decideOutcome applies the multi face policy to the compared faces
+func decideOutcome(policy string, faces []*faceComparison) outcome {
+	known, unknown, undetermined := 0, 0, 0
+	for _, face := range faces {
+		switch {
+		case face.known():
+			known++
+		case face.failed.Load():
+			undetermined++
+		default:
+			unknown++
+		}
+	}
+
+	switch policy {
+	case config.MultiFacePolicyAllKnown:
+		if unknown > 0 || len(faces) == 0 {
+			return outcomeNotRecognized
+		}
+	case config.MultiFacePolicyTailgating:
+		if known > 0 && unknown > 0 {
+			return outcomeTailgating
+		}
+		if known == 0 && undetermined == 0 {
+			return outcomeNotRecognized
+		}
+	default:
+		if known > 0 {
+			return outcomeRecognized
+		}
+		if undetermined == 0 {
+			return outcomeNotRecognized
+		}
+	}
+	if undetermined > 0 {
+		return outcomeUnavailable
+	}
+	return outcomeRecognized
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/adutchak/recognizer/pkg/events"
+	"github.com/adutchak/recognizer/pkg/imaging"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/gorilla/mux"
+)
+
+// eventsRetentionInterval is how often events older than the retention are removed
+const eventsRetentionInterval = time.Hour
+
+// eventOrigin tells where the snapshot came from
+type eventOrigin struct {
+	Source string
+	Camera string
+}
+
+// recognize processes the snapshot and records the event
+func (r *recognizer) recognize(ctx context.Context, origin eventOrigin, sourceBytes []byte, frames [][]byte) (recognitionResult, error) {
+	started := time.Now()
+	result, err := r.processImage(ctx, sourceBytes, frames)
+	r.recordEvent(ctx, origin, started, sourceBytes, result, err)
+	return result, err
+}
+
+func (r *recognizer) recordEvent(ctx context.Context, origin eventOrigin, started time.Time, sourceBytes []byte, result recognitionResult, err error) {
+	log := logging.WithContext(ctx)
+	if r.events == nil {
+		return
+	}
+	event := events.Event{
+		Time:                started.UTC(),
+		Camera:              origin.Camera,
+		Source:              origin.Source,
+		Decision:            result.Decision,
+		Labels:              result.Labels,
+		FailingRules:        result.FailingRules,
+		LatencyMilliseconds: time.Since(started).Milliseconds(),
+	}
+	if event.Labels == nil {
+		event.Labels = map[string]float32{}
+	}
+	if event.FailingRules == nil {
+		event.FailingRules = []string{}
+	}
+	switch {
+	case event.Decision == "" && err != nil:
+		event.Decision = decisionError
+	case event.Decision == "":
+		event.Decision = "discovery"
+	}
+	if err != nil {
+		event.Message = err.Error()
+	}
+	if len(result.Faces) > 0 {
+		if event.Faces, err = json.Marshal(result.Faces); err != nil {
+			log.Errorf("Cannot record the faces of the event: %v", err)
+		}
+	}
+	if result.Liveness != nil {
+		if event.Liveness, err = json.Marshal(result.Liveness); err != nil {
+			log.Errorf("Cannot record the liveness of the event: %v", err)
+		}
+	}
+	for _, face := range result.Faces {
+		if face.Status == faceStatusKnown {
+			event.Person = face.Person
+			event.Similarity = face.Similarity
+			break
+		}
+	}
+
+	if r.configuration.EventsImagesDir != "" {
+		imagePath, err := r.archiveImage(sourceBytes, started)
+		if err != nil {
+			log.Errorf("Cannot archive the snapshot: %v", err)
+		}
+		event.ImagePath = imagePath
+	}
+	id, err := r.events.Record(ctx, event)
+	if err != nil {
+		log.Errorf("Cannot record the event: %v", err)
+		return
+	}
+	log.Infof("Recorded event %d: %s", id, event.Decision)
+}
+
+// archiveImage stores the snapshot as it was received in a directory of the day
+func (r *recognizer) archiveImage(sourceBytes []byte, at time.Time) (string, error) {
+	extension := ".bin"
+	if format, err := imaging.DetectFormat(sourceBytes); err == nil {
+		extension = formatExtensions[format]
+	}
+	dir := filepath.Join(r.configuration.EventsImagesDir, at.UTC().Format("2006-01-02"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, at.UTC().Format("150405.000000000")+extension)
+	return path, os.WriteFile(path, sourceBytes, 0o644)
+}
+
+// runEventsRetention removes events older than the retention along with their snapshots
+func (r *recognizer) runEventsRetention(ctx context.Context) {
+	ticker := time.NewTicker(eventsRetentionInterval)
+	defer ticker.Stop()
+	for {
+		r.pruneEvents(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *recognizer) pruneEvents(ctx context.Context, now time.Time) {
+	log := logging.WithContext(ctx)
+	images, err := r.events.Prune(ctx, now.AddDate(0, 0, -r.configuration.EventsRetentionDays))
+	if err != nil {
+		log.Errorf("Cannot remove old events: %v", err)
+		return
+	}
+	for _, image := range images {
+		if err := os.Remove(image); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Cannot remove snapshot %s: %v", image, err)
+		}
+		// the directory of the day is removed with its last snapshot, non-empty directories are kept
+		os.Remove(filepath.Dir(image))
+	}
+	if len(images) > 0 {
+		log.Infof("Removed %d snapshots of old events", len(images))
+	}
+}
+
+// apiCamera names the camera of the API request: the name given in the request or in the configuration,
+// otherwise the host of the stream
+func (r *recognizer) apiCamera(input RecognizeApiInput) string {
+	if input.Camera != "" {
+		return input.Camera
+	}
+	if r.configuration.CameraName != "" {
+		return r.configuration.CameraName
+	}
+	if parsed, err := url.Parse(input.WebRtcUrl); err == nil && parsed.Hostname() != "" {
+		return parsed.Hostname()
+	}
+	return "unknown"
+}
+
+// fileWatcherCamera names the camera of the snapshot file
+func (r *recognizer) fileWatcherCamera() string {
+	if r.configuration.CameraName != "" {
+		return r.configuration.CameraName
+	}
+	return filepath.Base(r.configuration.TargetImagePath)
+}
+
+type eventResponse struct {
+	events.Event
+	// ImageUrl is set when the snapshot of the event was archived
+	ImageUrl string `json:"imageUrl,omitempty"`
+}
+
+type eventsResponse struct {
+	Events []eventResponse `json:"events"`
+	// Next is the value of "before" for the next page, it is missing on the last page
+	Next int64 `json:"next,omitempty"`
+}
+
+// ListEventsApiHandler lists events, the most recent first, filtered by the query parameters
+// from, to (RFC 3339), camera, person and decision, paginated with limit and before
+func (r *recognizer) ListEventsApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireEvents(writer) {
+		return
+	}
+	filter, err := parseEventsFilter(request.URL.Query())
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	found, err := r.events.Query(ctx, filter)
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	response := eventsResponse{Events: []eventResponse{}}
+	for _, event := range found {
+		response.Events = append(response.Events, newEventResponse(event))
+	}
+	if len(found) > 0 && len(found) == effectiveLimit(filter.Limit) {
+		response.Next = found[len(found)-1].Id
+	}
+	respondWithJSON(writer, http.StatusOK, response)
+}
+
+func (r *recognizer) GetEventApiHandler(writer http.ResponseWriter, request *http.Request) {
+	event, ok := r.requestedEvent(writer, request)
+	if !ok {
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, newEventResponse(event))
+}
+
+// GetEventImageApiHandler serves the archived snapshot of the event
+func (r *recognizer) GetEventImageApiHandler(writer http.ResponseWriter, request *http.Request) {
+	event, ok := r.requestedEvent(writer, request)
+	if !ok {
+		return
+	}
+	if event.ImagePath == "" {
+		respondWithError(writer, http.StatusNotFound, fmt.Sprintf("snapshot of event %d was not archived", event.Id))
+		return
+	}
+	if _, err := os.Stat(event.ImagePath); err != nil {
+		respondWithError(writer, http.StatusNotFound, fmt.Sprintf("snapshot of event %d is missing", event.Id))
+		return
+	}
+	http.ServeFile(writer, request, event.ImagePath)
+}
+
+func (r *recognizer) requestedEvent(writer http.ResponseWriter, request *http.Request) (events.Event, bool) {
+	if !r.requireEvents(writer) {
+		return events.Event{}, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(request)["event"], 10, 64)
+	if err != nil {
+		respondWithError(writer, http.StatusNotFound, "event "+mux.Vars(request)["event"]+" not found")
+		return events.Event{}, false
+	}
+	event, err := r.events.Get(context.Background(), id)
+	if errors.Is(err, events.ErrNotFound) {
+		respondWithError(writer, http.StatusNotFound, err.Error())
+		return events.Event{}, false
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return events.Event{}, false
+	}
+	return event, true
+}
+
+func (r *recognizer) requireEvents(writer http.ResponseWriter) bool {
+	if r.events == nil {
+		respondWithError(writer, http.StatusConflict, "events are recorded only when the events database is configured")
+		return false
+	}
+	return true
+}
+
+func newEventResponse(event events.Event) eventResponse {
+	response := eventResponse{Event: event}
+	if event.ImagePath != "" {
+		response.ImageUrl = fmt.Sprintf("/v1/events/%d/image", event.Id)
+	}
+	return response
+}
+
+func parseEventsFilter(query url.Values) (events.Filter, error) {
+	filter := events.Filter{
+		Camera:   query.Get("camera"),
+		Person:   query.Get("person"),
+		Decision: query.Get("decision"),
+	}
+	var err error
+	if value := query.Get("from"); value != "" {
+		if filter.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("invalid from, an RFC 3339 time is expected: %w", err)
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if filter.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("invalid to, an RFC 3339 time is expected: %w", err)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > events.MaxLimit {
+			return filter, fmt.Errorf("invalid limit, a number from 1 to %d is expected", events.MaxLimit)
+		}
+	}
+	if value := query.Get("before"); value != "" {
+		if filter.Before, err = strconv.ParseInt(value, 10, 64); err != nil || filter.Before < 1 {
+			return filter, fmt.Errorf("invalid before, an event id is expected")
+		}
+	}
+	return filter, nil
+}
+
+func effectiveLimit(limit int) int {
+	if limit <= 0 || limit > events.MaxLimit {
+		return events.MaxLimit
+	}
+	return limit
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/adutchak/recognizer/pkg/jobs"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/gorilla/mux"
+)
+
+// jobResult is the result of an asynchronous recognition
+type jobResult struct {
+	// StatusCode is the status the synchronous request would respond with
+	StatusCode int    `json:"statusCode"`
+	Decision   string `json:"decision,omitempty"`
+	Response
+}
+
+// submitRecognition queues the recognition and responds with the queued job
+func (r *recognizer) submitRecognition(writer http.ResponseWriter, recognizeInput RecognizeApiInput) {
+	log := logging.WithContext(context.Background())
+	if r.jobs == nil {
+		respondWithError(writer, http.StatusConflict, "asynchronous recognition is available only in api mode")
+		return
+	}
+	if recognizeInput.CallbackUrl != "" {
+		callback, err := url.Parse(recognizeInput.CallbackUrl)
+		if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+			respondWithError(writer, http.StatusBadRequest, "invalid callback_url, an http or https URL is expected")
+			return
+		}
+	}
+	job, err := r.jobs.Submit(func(ctx context.Context) (interface{}, error) {
+		statusCode, response, decision := r.recognizeStream(ctx, recognizeInput)
+		result := jobResult{StatusCode: statusCode, Decision: decision, Response: response}
+		// a decision which is not an error is a result of the recognition, even when the caller is not recognized
+		if statusCode != http.StatusOK && (decision == "" || decision == decisionError) {
+			return result, errors.New(response.Message)
+		}
+		return result, nil
+	}, recognizeInput.CallbackUrl)
+	if errors.Is(err, jobs.ErrQueueFull) {
+		log.Error(err)
+		respondWithError(writer, http.StatusServiceUnavailable, "too many recognitions are waiting, "+err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Infof("Queued recognition job %s", job.Id)
+	writer.Header().Set("Location", "/v1/jobs/"+job.Id)
+	respondWithJSON(writer, http.StatusAccepted, job)
+}
+
+// GetJobApiHandler reports the status of the asynchronous recognition along with the result when it is finished
+func (r *recognizer) GetJobApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if r.jobs == nil {
+		respondWithError(writer, http.StatusConflict, "asynchronous recognition is available only in api mode")
+		return
+	}
+	job, err := r.jobs.Get(mux.Vars(request)["job"])
+	if errors.Is(err, jobs.ErrNotFound) {
+		respondWithError(writer, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, job)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+
+	"github.com/adutchak/recognizer/pkg/liveness"
+)
+
+// checkLiveness detects the face on every frame and scores its natural motion,
+// all the attributes are requested in order to get eyes state. When the frames are taken apart from the snapshot,
+// the snapshot is given and the face on the frames is compared with it
+func (r *recognizer) checkLiveness(ctx context.Context, snapshot []byte, frames [][]byte) (liveness.Result, error) {
+	if len(frames) < 2 {
+		return liveness.Result{Frames: len(frames)}, fmt.Errorf("liveness check requires at least 2 frames, got %d", len(frames))
+	}
+	detected := make([][]types.FaceDetail, 0, len(frames))
+	for i, frame := range frames {
+		input := rekognition.DetectFacesInput{
+			Image:      &types.Image{Bytes: frame},
+			Attributes: []types.Attribute{types.AttributeAll},
+		}
+		var output *rekognition.DetectFacesOutput
+		err := r.callRekognition(ctx, func(ctx context.Context) (err error) {
+			output, err = r.recognizeClient.DetectFaces(ctx, &input)
+			return err
+		})
+		if err != nil {
+			return liveness.Result{Frames: len(frames)}, fmt.Errorf("cannot detect faces on frame %d: %w", i, err)
+		}
+		detected = append(detected, output.FaceDetails)
+	}
+	result := liveness.Analyze(detected)
+	if snapshot != nil {
+		matches, err := r.matchesSnapshot(ctx, snapshot, frames, detected)
+		if err != nil {
+			return result, err
+		}
+		result.MatchesSnapshot = &matches
+	}
+	return result, nil
+}
+
+// matchesSnapshot compares the face of the snapshot with the first frame showing a face, a single comparison
+// is enough. The largest face of the frame has to match, since the liveness analysis follows the largest face
+func (r *recognizer) matchesSnapshot(ctx context.Context, snapshot []byte, frames [][]byte, detected [][]types.FaceDetail) (bool, error) {
+	for i, faces := range detected {
+		if len(faces) == 0 {
+			continue
+		}
+		input := rekognition.CompareFacesInput{
+			SourceImage:         &types.Image{Bytes: snapshot},
+			TargetImage:         &types.Image{Bytes: frames[i]},
+			SimilarityThreshold: &r.configuration.SimilarityThreshold,
+			QualityFilter:       "AUTO",
+		}
+		var output *rekognition.CompareFacesOutput
+		err := r.callRekognition(ctx, func(ctx context.Context) (err error) {
+			output, err = r.recognizeClient.CompareFaces(ctx, &input)
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("cannot compare the face on frame %d with the snapshot: %w", i, err)
+		}
+		matches, largestArea := false, float32(-1)
+		for _, match := range output.FaceMatches {
+			if match.Face == nil {
+				continue
+			}
+			if area := boxArea(match.Face.BoundingBox); area > largestArea {
+				matches, largestArea = true, area
+			}
+		}
+		for _, unmatched := range output.UnmatchedFaces {
+			if area := boxArea(unmatched.BoundingBox); area > largestArea {
+				matches, largestArea = false, area
+			}
+		}
+		return matches, nil
+	}
+	return false, nil
+}
+
+func boxArea(box *types.BoundingBox) float32 {
+	if box == nil {
+		return 0
+	}
+	return aws.ToFloat32(box.Width) * aws.ToFloat32(box.Height)
+}
@@ -3,17 +3,28 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/adutchak/recognizer/pkg/aws"
+	"github.com/adutchak/recognizer/pkg/broadcast"
+	"github.com/adutchak/recognizer/pkg/capturestore"
 	"github.com/adutchak/recognizer/pkg/config"
+	"github.com/adutchak/recognizer/pkg/events"
+	"github.com/adutchak/recognizer/pkg/imaging"
+	"github.com/adutchak/recognizer/pkg/jobs"
+	"github.com/adutchak/recognizer/pkg/liveness"
 	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/mqttbroker"
 	"github.com/adutchak/recognizer/pkg/mqttclient"
+	"github.com/adutchak/recognizer/pkg/resilience"
+	"github.com/adutchak/recognizer/pkg/samplestore"
+	"github.com/adutchak/recognizer/pkg/visitors"
 
 	"github.com/aws/aws-sdk-go-v2/service/rekognition"
 	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
@@ -24,49 +35,169 @@ import (
 )
 
 type recognizer struct {
-	configuration     *config.Config
-	recognizeClient   *rekognition.Client
-	mqttClient        mqtt.Client
+	configuration   *config.Config
+	recognizeClient *rekognition.Client
+	mqttClient      mqtt.Client
+	mqttBroker      *mqttbroker.Broker
+	// samplesLock guards rekognitionInputs and sampleDigests, which are swapped when samples are reloaded,
+	// reloadLock makes sure that samples are not reloaded concurrently
+	samplesLock       sync.RWMutex
+	reloadLock        sync.Mutex
 	rekognitionInputs []map[string]rekognition.CompareFacesInput
+	sampleDigests     map[string]sampleDigest
+	sampleReports     []sampleReport
+	// sampleStore manages the people in the samples directory, nil when the directory is not configured
+	sampleStore *samplestore.Store
+	// captureStore keeps recent unrecognized captures, nil when the directory is not configured
+	captureStore *capturestore.Store
+	// visitors clusters unknown faces, nil when the directory is not configured
+	visitors     *visitors.Store
+	visitorsLock sync.Mutex
+	// events records every recognition, nil when the database is not configured
+	events *events.Store
+	// resultsStream delivers published results to the clients of the events stream
+	resultsStream *broadcast.Hub
+	// jobs processes asynchronous recognitions, nil unless in api mode
+	jobs           *jobs.Queue
+	retryPolicy    resilience.RetryPolicy
+	circuitBreaker *resilience.CircuitBreaker
+	// captureFrames takes snapshots from the stream, replaceable in tests
+	captureFrames func(url string, count int, interval time.Duration) ([][]byte, error)
+	// cropFaces cuts faces out of the snapshot, replaceable in tests
+	cropFaces func(image []byte, boxes []types.BoundingBox, margin float32) ([][]byte, error)
 }
 
+// errRecognitionUnavailable is returned when recognition could not be performed because of AWS or image processing errors
+var errRecognitionUnavailable = errors.New("recognition is unavailable")
+
 type RecognizeApiInput struct {
 	WebRtcUrl string `json:"webrtc_url"`
+	// Camera names the camera in recorded events, the host of the stream by default
+	Camera string `json:"camera"`
+	// Async queues the recognition and responds with the job right away
+	Async bool `json:"async"`
+	// CallbackUrl receives the finished job of an asynchronous recognition
+	CallbackUrl string `json:"callback_url"`
 }
 
 type Response struct {
-	Message string `json:"message"`
+	Message  string           `json:"message"`
+	Faces    []faceResult     `json:"faces,omitempty"`
+	Liveness *liveness.Result `json:"liveness,omitempty"`
+}
+
+// recognitionResult is what was found out about the snapshot
+type recognitionResult struct {
+	// Decision is the published outcome, empty in discovery mode
+	Decision string           `json:"decision"`
+	Faces    []faceResult     `json:"faces"`
+	Liveness *liveness.Result `json:"liveness,omitempty"`
+	// Labels are the confidences of the detected labels by name
+	Labels       map[string]float32 `json:"labels"`
+	FailingRules []string           `json:"failingRules"`
+}
+
+const (
+	decisionRecognized    = "recognized"
+	decisionNotRecognized = "not_recognized"
+	decisionTailgating    = "tailgating"
+	decisionError         = "error"
+)
+
+// publish reports the decision about the snapshot over MQTT
+func (r *recognizer) publish(result *recognitionResult, decision string) {
+	result.Decision = decision
+	messages := map[string]string{
+		decisionRecognized:    r.configuration.MqttRecognizedMessage,
+		decisionNotRecognized: r.configuration.MqttNotRecognizedMessage,
+		decisionTailgating:    r.configuration.MqttTailgatingMessage,
+		decisionError:         r.configuration.MqttErrorMessage,
+	}
+	publishMqttMessage(r.mqttClient, r.configuration.MqttTopic, messages[decision])
+	r.streamResult(*result)
 }
 
-func (r *recognizer) new() {
+func (r *recognizer) new(configuration *config.Config) {
 	ctx := context.Background()
 	log := logging.WithContext(ctx)
-	// load configuration
-	configuration, err := config.NewConfig()
-	if err != nil {
-		log.Fatalf("Could not load the configuration, %v", err)
-	}
-	log.Infof("Loaded config %s", awsutil.Prettify(configuration))
+	log.Infof("Loaded config %s", awsutil.Prettify(configuration.Redacted()))
 	r.configuration = configuration
+	r.resultsStream = broadcast.New(streamBuffer)
+
+	// start embedded mqtt broker before the client connects to it
+	if configuration.MqttEmbeddedBroker {
+		mqttBroker, err := mqttbroker.Start(ctx, configuration)
+		if err != nil {
+			log.Fatalf("Cannot start embedded MQTT broker: %v", err)
+		}
+		log.Infof("Started embedded MQTT broker on %s:%d", configuration.MqttEmbeddedBrokerHost, configuration.MqttPort)
+		r.mqttBroker = mqttBroker
+	}
 
 	// initialize mqtt client
 	mqttClient := mqttclient.GetMqttClient(configuration)
 	r.mqttClient = mqttClient
 
 	// initialize AWS recognize client
-	recognizeClient, err := aws.GetRekognitionClient()
+	recognizeClient, err := aws.GetRekognitionClient(configuration)
 	if err != nil {
-		message := "Cannot initialize AWS recognize client"
-		log.Fatal(message)
+		log.Fatalf("Cannot initialize AWS recognize client: %v", err)
 	}
 	r.recognizeClient = recognizeClient
+	r.retryPolicy = resilience.RetryPolicy{
+		MaxAttempts: configuration.AwsMaxAttempts,
+		BaseDelay:   time.Millisecond * time.Duration(configuration.AwsRetryBaseDelayMilliseconds),
+		MaxDelay:    time.Millisecond * time.Duration(configuration.AwsRetryMaxDelayMilliseconds),
+	}
+	r.circuitBreaker = resilience.NewCircuitBreaker(
+		"rekognition",
+		configuration.AwsCircuitBreakerFailureThreshold,
+		time.Millisecond*time.Duration(configuration.AwsCircuitBreakerOpenMilliseconds),
+	)
+
+	if configuration.ValidateSamples {
+		r.sampleReports, err = r.checkSamples(ctx)
+		if err != nil {
+			log.Fatalf("Refusing to start with invalid samples: %v", err)
+		}
+	}
 
 	// get rekognition inputs
-	rekognitionInputs, err := getRekognitionInputs(ctx, configuration)
+	rekognitionInputs, digests, err := getRekognitionInputs(ctx, configuration)
 	if err != nil {
-		log.Fatal("Cannot get rekognition inputs")
+		log.Fatalf("Cannot get rekognition inputs: %v", err)
 	}
-	r.rekognitionInputs = rekognitionInputs
+	r.setInputs(rekognitionInputs, digests)
+	if r.configuration.SampleImagesDir != "" {
+		r.sampleStore = samplestore.New(r.configuration.SampleImagesDir)
+	}
+	if r.configuration.CapturesDir != "" {
+		r.captureStore, err = capturestore.New(r.configuration.CapturesDir, r.configuration.CapturesMax)
+		if err != nil {
+			log.Fatalf("Cannot keep captures: %v", err)
+		}
+	}
+	if r.configuration.VisitorsDir != "" {
+		r.visitors, err = visitors.Open(r.configuration.VisitorsDir)
+		if err != nil {
+			log.Fatalf("Cannot track visitors: %v", err)
+		}
+		if err := r.ensureVisitorsCollection(ctx); err != nil {
+			log.Fatalf("Cannot create visitors collection %s: %v", r.configuration.VisitorsCollectionId, err)
+		}
+	}
+	if r.configuration.EventsDb != "" {
+		r.events, err = events.Open(ctx, r.configuration.EventsDb)
+		if err != nil {
+			log.Fatalf("Cannot record events: %v", err)
+		}
+	}
+	if r.configuration.RunMode == "api" {
+		expiry := time.Duration(r.configuration.JobsExpiryMinutes) * time.Minute
+		r.jobs = jobs.Start(ctx, r.configuration.JobsQueueSize, r.configuration.JobsWorkers, expiry)
+	}
+	r.captureFrames = captureWebRtcFrames
+	r.cropFaces = imaging.CropFaces
 }
 
 func main() {
@@ -76,41 +207,94 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not load the configuration, %v", err)
 	}
+	recognizer := recognizer{}
+	recognizer.new(configuration)
+	if configuration.WatchSamples && configuration.RunMode != "enroll" {
+		go func() {
+			if err := recognizer.watchSamples(ctx); err != nil {
+				log.Errorf("Samples are not reloaded: %v", err)
+			}
+		}()
+	}
+	if recognizer.events != nil && configuration.RunMode != "enroll" {
+		go recognizer.runEventsRetention(ctx)
+	}
 	switch configuration.RunMode {
 	case "file_watcher":
-		runFileWatcher()
+		recognizer.runFileWatcher(ctx)
 	case "api":
-		runApi()
+		recognizer.runApi()
+	case "enroll":
+		recognizer.runEnroll(ctx)
 	}
 }
 
-func runApi() {
+func (r *recognizer) runApi() {
 	ctx := context.Background()
 	log := logging.WithContext(ctx)
-	r := mux.NewRouter()
-	v1 := r.PathPrefix("/v1").Subrouter()
-	recognizer := recognizer{}
-	recognizer.new()
-
-	// register all the handlers here
-	v1.HandleFunc("/recognize", recognizer.RecognizeWebRtcApiHandler).Methods("POST")
 
-	server := &http.Server{
-		Addr:         ":8082",
-		Handler:      r,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  10 * time.Second,
+	server, err := r.newApiServer(ctx)
+	if err != nil {
+		log.Fatalf("Cannot configure API server: %v", err)
 	}
 
-	log.Info("Starting recognizer API server on :8082")
-	if err := server.ListenAndServe(); err != nil {
+	if !r.configuration.CompiledApiKeys.Enabled() {
+		log.Warnf("API keys are not configured, the API accepts unauthenticated requests")
+	}
+	if server.TLSConfig == nil {
+		log.Infof("Starting recognizer API server on %s", server.Addr)
+		err = server.ListenAndServe()
+	} else {
+		if r.configuration.ApiHttpRedirectAddress != "" {
+			go r.runHttpsRedirect()
+		}
+		log.Infof("Starting recognizer API server with TLS on %s", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
 		log.Fatalf("Error starting Storm API server: %v", err)
 	}
 
 	select {}
 }
 
+func (r *recognizer) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.Use(r.authenticate)
+
+	// register all the handlers here
+	v1.HandleFunc("/recognize", r.RecognizeWebRtcApiHandler).Methods("POST")
+	v1.HandleFunc("/people", r.ListPeopleApiHandler).Methods("GET")
+	v1.HandleFunc("/people", r.CreatePersonApiHandler).Methods("POST")
+	v1.HandleFunc("/people/{person}", r.RenamePersonApiHandler).Methods("PATCH")
+	v1.HandleFunc("/people/{person}", r.DeletePersonApiHandler).Methods("DELETE")
+	v1.HandleFunc("/people/{person}/samples", r.AddSampleApiHandler).Methods("POST")
+	v1.HandleFunc("/people/{person}/samples/{sample}", r.GetSampleApiHandler).Methods("GET")
+	v1.HandleFunc("/people/{person}/samples/{sample}", r.DeleteSampleApiHandler).Methods("DELETE")
+	v1.HandleFunc("/captures", r.ListCapturesApiHandler).Methods("GET")
+	v1.HandleFunc("/captures/{capture}", r.GetCaptureApiHandler).Methods("GET")
+	v1.HandleFunc("/captures/{capture}", r.DeleteCaptureApiHandler).Methods("DELETE")
+	v1.HandleFunc("/captures/{capture}/snapshot", r.GetCaptureSnapshotApiHandler).Methods("GET")
+	v1.HandleFunc("/captures/{capture}/faces/{face}", r.GetCaptureFaceApiHandler).Methods("GET")
+	v1.HandleFunc("/captures/{capture}/enroll", r.EnrollCaptureApiHandler).Methods("POST")
+	v1.HandleFunc("/visitors", r.ListVisitorsApiHandler).Methods("GET")
+	v1.HandleFunc("/visitors/{visitor}", r.GetVisitorApiHandler).Methods("GET")
+	v1.HandleFunc("/visitors/{visitor}", r.DeleteVisitorApiHandler).Methods("DELETE")
+	v1.HandleFunc("/visitors/{visitor}/images/{image}", r.GetVisitorImageApiHandler).Methods("GET")
+	v1.HandleFunc("/visitors/{visitor}/enroll", r.EnrollVisitorApiHandler).Methods("POST")
+	v1.HandleFunc("/events", r.ListEventsApiHandler).Methods("GET")
+	v1.HandleFunc("/events/stream", r.StreamEventsApiHandler).Methods("GET")
+	v1.HandleFunc("/events/{event}", r.GetEventApiHandler).Methods("GET")
+	v1.HandleFunc("/events/{event}/image", r.GetEventImageApiHandler).Methods("GET")
+	v1.HandleFunc("/jobs/{job}", r.GetJobApiHandler).Methods("GET")
+	v1.HandleFunc("/config", r.GetConfigApiHandler).Methods("GET")
+
+	router.PathPrefix("/ui/").Handler(uiHandler()).Methods("GET")
+	router.Handle("/", http.RedirectHandler("/ui/", http.StatusFound)).Methods("GET")
+	return router
+}
+
 func (r *recognizer) RecognizeWebRtcApiHandler(writer http.ResponseWriter, request *http.Request) {
 	log := logging.WithContext(context.TODO())
 	log.Info("Received API request to recognize")
@@ -123,52 +307,93 @@ func (r *recognizer) RecognizeWebRtcApiHandler(writer http.ResponseWriter, reque
 		respondWithError(writer, http.StatusBadRequest, message)
 		return
 	}
-
-	webcam, err := gocv.OpenVideoCapture(recognizeInput.WebRtcUrl)
-	if err != nil {
-		message := fmt.Sprintf("Error opening video capture device: %v\n", recognizeInput.WebRtcUrl)
-		respondWithError(writer, http.StatusBadRequest, message)
+	if recognizeInput.Async {
+		r.submitRecognition(writer, recognizeInput)
 		return
 	}
-	defer webcam.Close()
 
-	img := gocv.NewMat()
-	defer img.Close()
+	statusCode, response, _ := r.recognizeStream(ctx, recognizeInput)
+	respondWithJSON(writer, statusCode, response)
+}
 
-	if ok := webcam.Read(&img); !ok {
-		message := fmt.Sprintf("Cannot read device %v\n", recognizeInput.WebRtcUrl)
-		respondWithError(writer, http.StatusBadRequest, message)
-		return
+// recognizeStream recognizes the snapshot taken from the stream, the status code tells the outcome, the decision is
+// empty when the snapshot was not taken or in discovery mode
+func (r *recognizer) recognizeStream(ctx context.Context, recognizeInput RecognizeApiInput) (int, Response, string) {
+	log := logging.WithContext(ctx)
+	frames, err := r.captureFrames(recognizeInput.WebRtcUrl, r.framesCount(), r.frameInterval())
+	if err != nil {
+		log.Error(err)
+		return http.StatusBadRequest, Response{Message: err.Error()}, ""
 	}
-	if img.Empty() {
-		message := fmt.Sprintf("No image on device %v\n", recognizeInput.WebRtcUrl)
-		respondWithError(writer, http.StatusBadRequest, message)
-		return
+	result, err := r.recognize(ctx, eventOrigin{Source: "api", Camera: r.apiCamera(recognizeInput)}, frames[0], frames)
+	response := Response{
+		Message:  "Processed image successfully",
+		Faces:    result.Faces,
+		Liveness: result.Liveness,
 	}
-	sourceBuff, err := gocv.IMEncode(gocv.JPEGFileExt, img)
-	if err != nil {
-		message := fmt.Sprint("Cannot IMEncode image")
-		respondWithError(writer, http.StatusBadRequest, message)
-		return
+	if errors.Is(err, errRecognitionUnavailable) {
+		log.Error(err)
+		response.Message = err.Error()
+		return http.StatusServiceUnavailable, response, result.Decision
 	}
-	err = r.processImage(ctx, sourceBuff.GetBytes())
 	if err != nil {
 		log.Error(err)
-		respondWithError(writer, http.StatusBadRequest, err.Error())
-		return
+		response.Message = err.Error()
+		return http.StatusBadRequest, response, result.Decision
+	}
+	return http.StatusOK, response, result.Decision
+}
+
+// framesCount is the number of frames taken from the stream, several frames are needed only to check liveness
+func (r *recognizer) framesCount() int {
+	if r.configuration.LivenessEnabled {
+		return r.configuration.LivenessFrames
 	}
+	return 1
+}
 
-	respondWithJSON(writer, http.StatusOK, Response{
-		Message: "Processed image successfully",
-	})
+func (r *recognizer) frameInterval() time.Duration {
+	return time.Millisecond * time.Duration(r.configuration.LivenessFrameIntervalMilliseconds)
 }
 
-func runFileWatcher() {
-	ctx := context.Background()
-	log := logging.WithContext(ctx)
+// captureWebRtcFrames reads frames from the stream at the given interval and encodes them as JPEG
+func captureWebRtcFrames(url string, count int, interval time.Duration) ([][]byte, error) {
+	webcam, err := gocv.OpenVideoCapture(url)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening video capture device: %v", url)
+	}
+	defer webcam.Close()
 
-	recognizer := recognizer{}
-	recognizer.new()
+	img := gocv.NewMat()
+	defer img.Close()
+
+	frames := make([][]byte, 0, count)
+	next := time.Now()
+	for len(frames) < count {
+		// the stream is read continuously, otherwise the frames would come from a stale buffer
+		if ok := webcam.Read(&img); !ok {
+			return nil, fmt.Errorf("Cannot read device %v", url)
+		}
+		if img.Empty() {
+			return nil, fmt.Errorf("No image on device %v", url)
+		}
+		if time.Now().Before(next) {
+			continue
+		}
+		sourceBuff, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot IMEncode image")
+		}
+		// the buffer is released on close, so the bytes have to be copied
+		frames = append(frames, append([]byte(nil), sourceBuff.GetBytes()...))
+		sourceBuff.Close()
+		next = time.Now().Add(interval)
+	}
+	return frames, nil
+}
+
+func (r *recognizer) runFileWatcher(ctx context.Context) {
+	log := logging.WithContext(ctx)
 
 	log.Info("Starting recognizer")
 
@@ -177,25 +402,25 @@ func runFileWatcher() {
 		defer func() {
 			doneChan <- true
 		}()
-		for {
-			err := waitForFile(recognizer.configuration.TargetImagePath, recognizer.configuration.TargetImageVerifyEveryMilliseconds)
+		for ctx.Err() == nil {
+			err := waitForFile(ctx, r.configuration.TargetImagePath, r.configuration.TargetImageVerifyEveryMilliseconds)
 			if err != nil {
 				log.Error(err)
 				continue
 			}
-			sourceBytes, err := os.ReadFile(recognizer.configuration.TargetImagePath)
+			sourceBytes, err := os.ReadFile(r.configuration.TargetImagePath)
 			if err != nil {
-				log.Errorf("Error reading file %s: %v", recognizer.configuration.TargetImagePath, err)
-				removeFile(recognizer.configuration.TargetImagePath)
+				log.Errorf("Error reading file %s: %v", r.configuration.TargetImagePath, err)
+				removeFile(r.configuration.TargetImagePath)
 				continue
 			}
 			// should delete the file as soon as possible
-			err = removeFile(recognizer.configuration.TargetImagePath)
+			err = removeFile(r.configuration.TargetImagePath)
 			if err != nil {
 				log.Error(err)
 				continue
 			}
-			err = recognizer.processImage(ctx, sourceBytes)
+			_, err = r.recognize(ctx, eventOrigin{Source: "file_watcher", Camera: r.fileWatcherCamera()}, sourceBytes, nil)
 			if err != nil {
 				log.Error(err)
 			}
@@ -205,8 +430,31 @@ func runFileWatcher() {
 	<-doneChan
 }
 
-func (r *recognizer) processImage(ctx context.Context, sourceBytes []byte) error {
+// processImage recognizes the snapshot, frames are taken from the stream for the liveness check
+func (r *recognizer) processImage(ctx context.Context, sourceBytes []byte, frames [][]byte) (recognitionResult, error) {
 	log := logging.WithContext(ctx)
+	var result recognitionResult
+
+	// in file_watcher mode the snapshot is a file, so the liveness frames are taken from the stream,
+	// which may show someone else, so the face on the frames is compared with the snapshot
+	framesFromStream := r.configuration.LivenessEnabled && r.configuration.RunMode == "file_watcher"
+	var framesErr error
+	if framesFromStream {
+		frames, framesErr = r.captureFrames(r.configuration.LivenessStreamUrl, r.configuration.LivenessFrames, r.frameInterval())
+	}
+
+	sourceBytes, frames, err := r.prepareImages(sourceBytes, frames)
+	if err != nil {
+		log.Error("Error preparing image", err)
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionError)
+		}
+		// invalid images are reported as they are, retrying would not help
+		if errors.Is(err, imaging.ErrInvalidImage) {
+			return result, err
+		}
+		return result, fmt.Errorf("%w: %v", errRecognitionUnavailable, err)
+	}
 
 	sourceImage := types.Image{
 		Bytes: sourceBytes,
@@ -214,29 +462,62 @@ func (r *recognizer) processImage(ctx context.Context, sourceBytes []byte) error
 	detectFacesInput := rekognition.DetectFacesInput{
 		Image: &sourceImage,
 	}
+	if r.configuration.CompiledFaceRules.NeedsAllAttributes() {
+		detectFacesInput.Attributes = []types.Attribute{types.AttributeAll}
+	}
 	// recognizeClient.CreateFaceLivenessSession()
-	output, err := r.recognizeClient.DetectFaces(ctx, &detectFacesInput)
+	var output *rekognition.DetectFacesOutput
+	err = r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		output, err = r.recognizeClient.DetectFaces(ctx, &detectFacesInput)
+		return err
+	})
 	if err != nil {
 		log.Error("Error detecting face", err)
-		return err
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionError)
+		}
+		return result, fmt.Errorf("%w: %v", errRecognitionUnavailable, err)
 	}
 	if len(output.FaceDetails) == 0 {
 		message := fmt.Sprintf("No faces detected in the image: %s", r.configuration.TargetImagePath)
 		log.Errorf(message)
 		if !r.configuration.DiscoveryMode {
-			publishMqttMessage(r.mqttClient, r.configuration.MqttTopic, r.configuration.MqttNotRecognizedMessage)
-			return fmt.Errorf(message)
+			r.publish(&result, decisionNotRecognized)
+			return result, fmt.Errorf(message)
+		}
+	}
+	if r.configuration.DiscoveryMode {
+		log.Infof("DetectFaces output:\n%s", awsutil.Prettify(output.FaceDetails))
+	}
+
+	facesResult := r.configuration.CompiledFaceRules.Evaluate(output.FaceDetails)
+	for _, failure := range facesResult.Failures {
+		log.Error(failure)
+	}
+	result.FailingRules = append(result.FailingRules, facesResult.Failures...)
+	if !facesResult.Passed() {
+		message := "Some of the faces did not pass face rules"
+		log.Error(message)
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionNotRecognized)
+			return result, fmt.Errorf(message)
 		}
 	}
 
 	detectLabelsInputs := rekognition.DetectLabelsInput{
 		Image: &sourceImage,
 	}
-	labelsOutput, err := r.recognizeClient.DetectLabels(ctx, &detectLabelsInputs)
+	var labelsOutput *rekognition.DetectLabelsOutput
+	err = r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		labelsOutput, err = r.recognizeClient.DetectLabels(ctx, &detectLabelsInputs)
+		return err
+	})
 	if err != nil {
 		log.Error("Error detecting labels", err)
-		publishMqttMessage(r.mqttClient, r.configuration.MqttTopic, r.configuration.MqttNotRecognizedMessage)
-		return err
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionError)
+		}
+		return result, fmt.Errorf("%w: %v", errRecognitionUnavailable, err)
 	}
 	if r.configuration.DiscoveryMode {
 		log.Infof("DetectLabels output:\n%s", awsutil.Prettify(labelsOutput))
@@ -245,114 +526,144 @@ func (r *recognizer) processImage(ctx context.Context, sourceBytes []byte) error
 			err = writeToFile(r.configuration.DiscoveryLabelsFileOutput, awsutil.Prettify(labelsOutput))
 			if err != nil {
 				log.Error(err)
-				return err
+				return result, err
 			}
 		}
 	}
 
-	labelsPassed := true
+	result.Labels = make(map[string]float32, len(labelsOutput.Labels))
 	for _, label := range labelsOutput.Labels {
-		for labelName, threshold := range r.configuration.ConfidencesNotLessThanNormalized {
-			err = verifyLabelConfidenceNotLessThan(label, labelName, threshold)
-			if err != nil {
-				labelsPassed = false
-				// No return here, because we want to check all the labels
-				log.Error(err)
-			}
-		}
-
-		for labelName, threshold := range r.configuration.ConfidencesNotMoreThanNormalized {
-			err = verifyLabelConfidenceNotMoreThan(label, labelName, threshold)
-			if err != nil {
-				labelsPassed = false
-				// No return here, because we want to check all the labels
-				log.Error(err)
-			}
+		if label.Name != nil && label.Confidence != nil {
+			result.Labels[*label.Name] = *label.Confidence
 		}
 	}
+	labelsResult := r.configuration.CompiledLabelRules.Evaluate(labelsOutput.Labels)
+	for _, failure := range labelsResult.Failures {
+		log.Error(failure)
+	}
+	result.FailingRules = append(result.FailingRules, labelsResult.Failures...)
+	if len(labelsResult.MissingLabels) > 0 {
+		log.Errorf("Required labels were not detected: %s", strings.Join(labelsResult.MissingLabels, ", "))
+	}
 
-	if !labelsPassed {
+	if !labelsResult.Passed() {
 		message := "Some of the labels did not pass confidence level"
 		log.Error(message)
 		if !r.configuration.DiscoveryMode {
-			publishMqttMessage(r.mqttClient, r.configuration.MqttTopic, r.configuration.MqttNotRecognizedMessage)
-			return fmt.Errorf(message)
+			r.publish(&result, decisionNotRecognized)
+			return result, fmt.Errorf(message)
 		}
 	}
 
-	atLeastOneMatchFound := false
-	// use once in order to atomically change atLeastOneMatchFound variable
-	var atLeastOneMatchFoundOnce sync.Once
-	// use wait groups in order to process images in parallel
-	var wg sync.WaitGroup
-	wg.Add(len(r.rekognitionInputs))
-
-	for _, rekognitionInput := range r.rekognitionInputs {
-		go func(rekognitionInput map[string]rekognition.CompareFacesInput) {
-			defer wg.Done()
-			comparedFileName := ""
-			compareFacesInput := rekognition.CompareFacesInput{}
-			for filename, input := range rekognitionInput {
-				input.SourceImage = &sourceImage
-				compareFacesInput = input
-				comparedFileName = filename
+	if r.configuration.LivenessEnabled {
+		var failure string
+		if framesErr != nil {
+			failure = fmt.Sprintf("liveness frames could not be taken from the stream: %v", framesErr)
+		} else {
+			var snapshot []byte
+			if framesFromStream {
+				snapshot = sourceBytes
 			}
-
-			output, err := r.recognizeClient.CompareFaces(ctx, &compareFacesInput)
+			livenessResult, err := r.checkLiveness(ctx, snapshot, frames)
 			if err != nil {
-				log.Error("Error comparing faces", err)
-				return
+				log.Error("Error checking liveness", err)
+				if !r.configuration.DiscoveryMode {
+					r.publish(&result, decisionError)
+				}
+				return result, fmt.Errorf("%w: %v", errRecognitionUnavailable, err)
 			}
-
-			if len(output.FaceMatches) > 0 {
-				atLeastOneMatchFoundOnce.Do(func() {
-					atLeastOneMatchFound = true
-					log.Infof("recognized snapshot as %s", comparedFileName)
-					if !r.configuration.DiscoveryMode {
-						publishMqttMessage(r.mqttClient, r.configuration.MqttTopic, r.configuration.MqttRecognizedMessage)
-					}
-				})
-			} else {
-				log.Warnf("Did not recognize the caller as %s", comparedFileName)
+			result.Liveness = &livenessResult
+			log.Infof("Liveness score %f (movement %f, blink %f, parallax %f)", livenessResult.Score, livenessResult.Movement, livenessResult.Blink, livenessResult.Parallax)
+			switch {
+			case livenessResult.MatchesSnapshot != nil && !*livenessResult.MatchesSnapshot:
+				failure = "the face on the liveness frames is not the face of the snapshot"
+			case livenessResult.Score < r.configuration.LivenessThreshold:
+				failure = fmt.Sprintf("liveness score %.2f is less than %.2f", livenessResult.Score, r.configuration.LivenessThreshold)
+			}
+		}
+		if failure != "" {
+			message := "The face did not pass the liveness check"
+			log.Errorf("%s: %s", message, failure)
+			result.FailingRules = append(result.FailingRules, failure)
+			if !r.configuration.DiscoveryMode {
+				r.publish(&result, decisionNotRecognized)
+				return result, fmt.Errorf("%s: %s", message, failure)
 			}
-		}(rekognitionInput)
+		}
+	}
+
+	faces, err := r.compareFaces(ctx, sourceBytes, output.FaceDetails)
+	if err != nil {
+		log.Error("Error comparing faces", err)
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionError)
+		}
+		return result, fmt.Errorf("%w: %v", errRecognitionUnavailable, err)
 	}
-	wg.Wait()
 
-	if !atLeastOneMatchFound {
+	result.Faces = r.reportFaces(ctx, faces)
+	switch decideOutcome(r.configuration.MultiFacePolicy, faces) {
+	case outcomeRecognized:
+		log.Infof("Recognized the caller, %d faces detected", len(faces))
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionRecognized)
+		}
+		return result, nil
+	case outcomeTailgating:
 		if !r.configuration.DiscoveryMode {
-			publishMqttMessage(r.mqttClient, r.configuration.MqttTopic, r.configuration.MqttNotRecognizedMessage)
-			return fmt.Errorf("Did not recognize the caller")
+			r.publish(&result, decisionTailgating)
 		}
+		return result, fmt.Errorf("Tailgating detected, known and unknown faces on the snapshot")
+	case outcomeUnavailable:
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionError)
+		}
+		return result, fmt.Errorf("%w: could not compare the caller with all the samples", errRecognitionUnavailable)
+	default:
+		if !r.configuration.DiscoveryMode {
+			r.publish(&result, decisionNotRecognized)
+		}
+		r.trackVisitors(ctx, faces, result.Faces)
+		r.saveCapture(ctx, sourceBytes, faces, result.Faces)
+		return result, fmt.Errorf("Did not recognize the caller")
 	}
-	return nil
 }
 
-func getRekognitionInputs(ctx context.Context, configuration *config.Config) ([]map[string]rekognition.CompareFacesInput, error) {
-	log := logging.WithContext(ctx)
-	var rekognitionInputs []map[string]rekognition.CompareFacesInput
-	for _, sample := range configuration.SampleImagePaths {
-		targeBytes, err := os.ReadFile(sample)
+// prepareImages validates, preprocesses and normalizes the snapshot and the liveness frames,
+// so that faces are detected and compared on the same image in both run modes
+func (r *recognizer) prepareImages(sourceBytes []byte, frames [][]byte) ([]byte, [][]byte, error) {
+	prepared, err := r.prepareImage(sourceBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	preparedFrames := make([][]byte, 0, len(frames))
+	for i, frame := range frames {
+		preparedFrame, err := r.prepareImage(frame)
 		if err != nil {
-			log.Errorf("Error reading file %s: %v", sample, err)
-			return rekognitionInputs, err
-		}
-
-		targetImage := types.Image{
-			Bytes: targeBytes,
+			return nil, nil, fmt.Errorf("frame %d: %w", i, err)
 		}
+		preparedFrames = append(preparedFrames, preparedFrame)
+	}
+	return prepared, preparedFrames, nil
+}
 
-		compareFacesInput := rekognition.CompareFacesInput{
-			TargetImage:         &targetImage,
-			SimilarityThreshold: &configuration.SimilarityThreshold,
-			QualityFilter:       "AUTO",
-		}
-		element := map[string]rekognition.CompareFacesInput{
-			sample: compareFacesInput,
-		}
-		rekognitionInputs = append(rekognitionInputs, element)
+func (r *recognizer) prepareImage(imageBytes []byte) ([]byte, error) {
+	// unsupported formats are reported before gocv fails to decode them
+	if _, err := imaging.DetectFormat(imageBytes); err != nil {
+		return nil, err
+	}
+	preprocessed, err := imaging.Preprocess(imageBytes, r.configuration.Preprocessing)
+	if err != nil {
+		return nil, err
 	}
-	return rekognitionInputs, nil
+	return imaging.Normalize(preprocessed, imaging.MaxImageBytes)
+}
+
+// callRekognition calls AWS through the circuit breaker, retrying transient errors
+func (r *recognizer) callRekognition(ctx context.Context, call func(ctx context.Context) error) error {
+	return r.circuitBreaker.Execute(func() error {
+		return resilience.Retry(ctx, r.retryPolicy, call)
+	})
 }
 
 func publishMqttMessage(client mqtt.Client, topic string, message interface{}) {
@@ -368,11 +679,15 @@ func publishMqttMessage(client mqtt.Client, topic string, message interface{}) {
 	log.Infof("Published message (%s) to MQTT topic %s", message, topic)
 }
 
-func waitForFile(filePath string, verifyFrequencyMs int) error {
+func waitForFile(ctx context.Context, filePath string, verifyFrequencyMs int) error {
 	for {
 		_, err := os.Stat(filePath)
 		if err != nil {
-			time.Sleep(time.Millisecond * time.Duration(verifyFrequencyMs))
+			select {
+			case <-time.After(time.Millisecond * time.Duration(verifyFrequencyMs)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			continue
 		}
 		break
@@ -393,34 +708,6 @@ func removeFile(filename string) error {
 	return nil
 }
 
-func verifyLabelConfidenceNotLessThan(label types.Label, labelName string, confidence string) error {
-	var confidenceFloat64 float64
-
-	confidenceFloat64, err := strconv.ParseFloat(confidence, 32)
-	if err != nil {
-		return err
-	}
-
-	if *label.Name == labelName && *label.Confidence < float32(confidenceFloat64) {
-		return fmt.Errorf("Label %s has confidence less than %s (%f)", labelName, confidence, *label.Confidence)
-	}
-	return nil
-}
-
-func verifyLabelConfidenceNotMoreThan(label types.Label, labelName string, confidence string) error {
-	var confidenceFloat64 float64
-
-	confidenceFloat64, err := strconv.ParseFloat(confidence, 32)
-	if err != nil {
-		return err
-	}
-
-	if *label.Name == labelName && *label.Confidence > float32(confidenceFloat64) {
-		return fmt.Errorf("Label %s has confidence more than %s (%f)", labelName, confidence, *label.Confidence)
-	}
-	return nil
-}
-
 func writeToFile(filename string, text string) error {
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/adutchak/recognizer/pkg/imaging"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/samplestore"
+)
+
+// maxSampleUploadBytes limits uploaded samples, larger images than Rekognition accepts are accepted with a warning
+// and downscaled on load
+const maxSampleUploadBytes = 4 * imaging.MaxImageBytes
+
+// sampleUploadTimeout replaces the read and write timeouts of the server for sample uploads,
+// which take longer than API calls on slow uplinks
+const sampleUploadTimeout = 2 * time.Minute
+
+// formatExtensions are the extensions of stored samples by their format
+var formatExtensions = map[imaging.Format]string{
+	imaging.FormatJPEG: ".jpg",
+	imaging.FormatPNG:  ".png",
+	imaging.FormatWebP: ".webp",
+	imaging.FormatBMP:  ".bmp",
+	imaging.FormatTIFF: ".tiff",
+}
+
+type personRequest struct {
+	Name string `json:"name"`
+}
+
+type sampleResponse struct {
+	samplestore.Sample
+	// Loaded tells whether the sample is used for recognition, invalid samples are not loaded in strict mode
+	Loaded bool `json:"loaded"`
+}
+
+type personResponse struct {
+	Name string `json:"name"`
+	// Managed people are stored in the samples directory and can be changed through the API
+	Managed bool             `json:"managed"`
+	Samples []sampleResponse `json:"samples"`
+}
+
+type peopleResponse struct {
+	People []personResponse `json:"people"`
+}
+
+type addSampleResponse struct {
+	Sample sampleResponse `json:"sample"`
+	Report *sampleReport  `json:"report,omitempty"`
+}
+
+func (r *recognizer) ListPeopleApiHandler(writer http.ResponseWriter, request *http.Request) {
+	people, err := r.people()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, peopleResponse{People: people})
+}
+
+func (r *recognizer) CreatePersonApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireSampleStore(writer) {
+		return
+	}
+	var body personRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		respondWithError(writer, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if err := r.sampleStore.CreatePerson(body.Name); err != nil {
+		respondWithStoreError(writer, err)
+		return
+	}
+	logging.WithContext(ctx).Infof("Created person %s", body.Name)
+	r.respondWithPerson(writer, http.StatusCreated, body.Name)
+}
+
+func (r *recognizer) RenamePersonApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireSampleStore(writer) {
+		return
+	}
+	person := mux.Vars(request)["person"]
+	var body personRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		respondWithError(writer, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if err := r.sampleStore.RenamePerson(person, body.Name); err != nil {
+		respondWithStoreError(writer, err)
+		return
+	}
+	logging.WithContext(ctx).Infof("Renamed person %s to %s", person, body.Name)
+	r.reloadAfterChange(ctx)
+	r.respondWithPerson(writer, http.StatusOK, body.Name)
+}
+
+func (r *recognizer) DeletePersonApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireSampleStore(writer) {
+		return
+	}
+	person := mux.Vars(request)["person"]
+	if err := r.sampleStore.DeletePerson(person); err != nil {
+		respondWithStoreError(writer, err)
+		return
+	}
+	logging.WithContext(ctx).Infof("Deleted person %s", person)
+	r.reloadAfterChange(ctx)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// AddSampleApiHandler stores the image sent either as the request body or as the "sample" field of a multipart form,
+// samples are validated before being stored when sample validation is enabled
+func (r *recognizer) AddSampleApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	log := logging.WithContext(ctx)
+	if !r.requireSampleStore(writer) {
+		return
+	}
+	person := mux.Vars(request)["person"]
+	content, err := readSampleUpload(writer, request)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	format, err := imaging.DetectFormat(content)
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var report *sampleReport
+	if r.configuration.ValidateSamples {
+		validated := r.validateSampleBytes(ctx, person+"/upload", content)
+		report = &validated
+		if !validated.valid() {
+			log.Warnf("Rejected sample of %s: %s", person, strings.Join(validated.Problems, "; "))
+			respondWithJSON(writer, http.StatusUnprocessableEntity, addSampleResponse{Report: report})
+			return
+		}
+	}
+
+	sample, err := r.sampleStore.AddSample(person, content, formatExtensions[format])
+	if err != nil {
+		respondWithStoreError(writer, err)
+		return
+	}
+	if report != nil {
+		report.Sample = sample.Path
+	}
+	log.Infof("Added sample %s of %s", sample.Name, person)
+	r.reloadAfterChange(ctx)
+	respondWithJSON(writer, http.StatusCreated, addSampleResponse{
+		Sample: sampleResponse{Sample: sample, Loaded: r.loaded(sample.Path)},
+		Report: report,
+	})
+}
+
+func (r *recognizer) GetSampleApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireSampleStore(writer) {
+		return
+	}
+	vars := mux.Vars(request)
+	sample, err := r.sampleStore.Sample(vars["person"], vars["sample"])
+	if err != nil {
+		respondWithStoreError(writer, err)
+		return
+	}
+	http.ServeFile(writer, request, sample.Path)
+}
+
+func (r *recognizer) DeleteSampleApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireSampleStore(writer) {
+		return
+	}
+	vars := mux.Vars(request)
+	if err := r.sampleStore.DeleteSample(vars["person"], vars["sample"]); err != nil {
+		respondWithStoreError(writer, err)
+		return
+	}
+	logging.WithContext(ctx).Infof("Deleted sample %s of %s", vars["sample"], vars["person"])
+	r.reloadAfterChange(ctx)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// people lists the people in the samples directory and the people of the samples specified explicitly
+func (r *recognizer) people() ([]personResponse, error) {
+	people := []personResponse{}
+	if r.sampleStore != nil {
+		stored, err := r.sampleStore.People()
+		if err != nil {
+			return nil, err
+		}
+		for _, person := range stored {
+			response := personResponse{Name: person.Name, Managed: true, Samples: []sampleResponse{}}
+			for _, sample := range person.Samples {
+				response.Samples = append(response.Samples, sampleResponse{Sample: sample, Loaded: r.loaded(sample.Path)})
+			}
+			people = append(people, response)
+		}
+	}
+	for _, path := range r.configuration.SampleImagePaths {
+		sample := samplestore.Sample{Person: r.personOf(path), Name: filepath.Base(path), Path: path}
+		if info, err := os.Stat(path); err == nil {
+			sample.Bytes = info.Size()
+		}
+		people = append(people, personResponse{
+			Name:    sample.Person,
+			Samples: []sampleResponse{{Sample: sample, Loaded: r.loaded(path)}},
+		})
+	}
+	return people, nil
+}
+
+func (r *recognizer) respondWithPerson(writer http.ResponseWriter, statusCode int, name string) {
+	people, err := r.people()
+	if err != nil {
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, person := range people {
+		if person.Managed && person.Name == name {
+			respondWithJSON(writer, statusCode, person)
+			return
+		}
+	}
+	respondWithError(writer, http.StatusNotFound, "person "+name+" not found")
+}
+
+// loaded tells whether the sample is currently used for recognition
+func (r *recognizer) loaded(sample string) bool {
+	r.samplesLock.RLock()
+	defer r.samplesLock.RUnlock()
+	_, ok := r.sampleDigests[sample]
+	return ok
+}
+
+// reloadAfterChange applies the change of samples right away instead of waiting for the samples watcher
+func (r *recognizer) reloadAfterChange(ctx context.Context) {
+	if _, err := r.reloadSamples(ctx); err != nil {
+		logging.WithContext(ctx).Errorf("Cannot reload samples: %v", err)
+	}
+}
+
+func (r *recognizer) requireSampleStore(writer http.ResponseWriter) bool {
+	if r.sampleStore == nil {
+		respondWithError(writer, http.StatusConflict, "people can be managed only when the samples directory is configured")
+		return false
+	}
+	return true
+}
+
+func readSampleUpload(writer http.ResponseWriter, request *http.Request) ([]byte, error) {
+	controller := http.NewResponseController(writer)
+	deadline := time.Now().Add(sampleUploadTimeout)
+	if err := controller.SetReadDeadline(deadline); err != nil {
+		logging.WithContext(context.Background()).Warnf("Cannot extend the read timeout of the sample upload: %v", err)
+	}
+	// the write timeout of the server runs from the start of the request, so it would expire during the upload
+	if err := controller.SetWriteDeadline(deadline); err != nil {
+		logging.WithContext(context.Background()).Warnf("Cannot extend the write timeout of the sample upload: %v", err)
+	}
+	request.Body = http.MaxBytesReader(writer, request.Body, maxSampleUploadBytes)
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+		return io.ReadAll(request.Body)
+	}
+	file, _, err := request.FormFile("sample")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func respondWithStoreError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, samplestore.ErrNotFound):
+		respondWithError(writer, http.StatusNotFound, err.Error())
+	case errors.Is(err, samplestore.ErrExists):
+		respondWithError(writer, http.StatusConflict, err.Error())
+	case errors.Is(err, samplestore.ErrInvalidName):
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+	default:
+		respondWithError(writer, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ScopeRecognize allows to trigger recognition and to get its results
+	ScopeRecognize = "recognize"
+	// ScopeEnroll allows to manage people, captures and visitors
+	ScopeEnroll = "enroll"
+	// ScopeAdmin allows everything
+	ScopeAdmin = "admin"
+
+	hashPrefix = "sha256:"
+)
+
+var knownScopes = map[string]bool{ScopeRecognize: true, ScopeEnroll: true, ScopeAdmin: true}
+
+// Key is an API key as written in the configuration, only the hash of the key is configured
+type Key struct {
+	Name string `mapstructure:"name" json:"name"`
+	// Hash is "sha256:" followed by the hex encoded SHA-256 digest of the key
+	Hash   string   `mapstructure:"hash" json:"hash"`
+	Scopes []string `mapstructure:"scopes" json:"scopes"`
+}
+
+// Allows tells whether the key has the scope, admin keys have all the scopes
+func (k Key) Allows(scope string) bool {
+	for _, allowed := range k.Scopes {
+		if allowed == scope || allowed == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys checks presented API keys against the configured ones
+type Keys struct {
+	keys    []Key
+	digests [][]byte
+}
+
+// Compile validates the configured keys, no keys means that the API is not authenticated
+func Compile(keys []Key) (*Keys, error) {
+	compiled := &Keys{}
+	names := map[string]bool{}
+	for i, key := range keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("API key %d: name is required", i+1)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("API key %s is configured more than once", key.Name)
+		}
+		names[key.Name] = true
+		digest, err := hex.DecodeString(strings.TrimPrefix(key.Hash, hashPrefix))
+		if !strings.HasPrefix(key.Hash, hashPrefix) || err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("API key %s: hash should be %s followed by the hex encoded SHA-256 digest of the key", key.Name, hashPrefix)
+		}
+		if len(key.Scopes) == 0 {
+			return nil, fmt.Errorf("API key %s: at least one scope is required", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			if !knownScopes[scope] {
+				return nil, fmt.Errorf("API key %s: unknown scope %q, allowed are %s, %s and %s", key.Name, scope, ScopeRecognize, ScopeEnroll, ScopeAdmin)
+			}
+		}
+		compiled.keys = append(compiled.keys, key)
+		compiled.digests = append(compiled.digests, digest)
+	}
+	return compiled, nil
+}
+
+// Enabled tells whether requests have to be authenticated
+func (k *Keys) Enabled() bool {
+	return k != nil && len(k.keys) > 0
+}
+
+// Authenticate finds the configured key of the presented one, all the keys are compared in constant time,
+// so that the time does not tell how much of a key matched nor which key matched
+func (k *Keys) Authenticate(presented string) (Key, bool) {
+	digest := sha256.Sum256([]byte(presented))
+	found := -1
+	for i, configured := range k.digests {
+		if subtle.ConstantTimeCompare(digest[:], configured) == 1 {
+			found = i
+		}
+	}
+	if found < 0 || presented == "" {
+		return Key{}, false
+	}
+	return k.keys[found], true
+}
+
+// Hash is the configured hash of the key
+func Hash(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	hash := Hash("secret")
+	tests := []struct {
+		name  string
+		keys  []Key
+		error string
+	}{
+		{name: "no keys"},
+		{name: "valid keys", keys: []Key{
+			{Name: "ha", Hash: hash, Scopes: []string{ScopeRecognize}},
+			{Name: "ops", Hash: Hash("other"), Scopes: []string{ScopeEnroll, ScopeAdmin}},
+		}},
+		{name: "missing name", keys: []Key{{Hash: hash, Scopes: []string{ScopeRecognize}}}, error: "API key 1: name is required"},
+		{name: "duplicate name", keys: []Key{
+			{Name: "ha", Hash: hash, Scopes: []string{ScopeRecognize}},
+			{Name: "ha", Hash: Hash("other"), Scopes: []string{ScopeRecognize}},
+		}, error: "API key ha is configured more than once"},
+		{name: "missing hash prefix", keys: []Key{{Name: "ha", Hash: strings.TrimPrefix(hash, hashPrefix), Scopes: []string{ScopeRecognize}}}, error: "hash should be"},
+		{name: "other hash prefix", keys: []Key{{Name: "ha", Hash: "md5:" + strings.TrimPrefix(hash, hashPrefix), Scopes: []string{ScopeRecognize}}}, error: "hash should be"},
+		{name: "short digest", keys: []Key{{Name: "ha", Hash: hash[:len(hash)-2], Scopes: []string{ScopeRecognize}}}, error: "hash should be"},
+		{name: "digest which is not hex", keys: []Key{{Name: "ha", Hash: hashPrefix + strings.Repeat("z", 64), Scopes: []string{ScopeRecognize}}}, error: "hash should be"},
+		{name: "no scopes", keys: []Key{{Name: "ha", Hash: hash}}, error: "at least one scope is required"},
+		{name: "unknown scope", keys: []Key{{Name: "ha", Hash: hash, Scopes: []string{ScopeRecognize, "write"}}}, error: `unknown scope "write"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compiled, err := Compile(test.keys)
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("expected the keys to compile, got %v", err)
+				}
+				if compiled.Enabled() != (len(test.keys) > 0) {
+					t.Fatalf("expected authentication to be enabled only with keys, got %t", compiled.Enabled())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected error containing %q, got %v", test.error, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys, err := Compile([]Key{
+		{Name: "ha", Hash: Hash("ha secret"), Scopes: []string{ScopeRecognize}},
+		{Name: "ops", Hash: Hash("ops secret"), Scopes: []string{ScopeAdmin}},
+		{Name: "empty", Hash: Hash(""), Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		presented string
+		key       string
+		allowed   []string
+		denied    []string
+	}{
+		{name: "recognize key", presented: "ha secret", key: "ha", allowed: []string{ScopeRecognize}, denied: []string{ScopeEnroll, ScopeAdmin}},
+		{name: "admin key", presented: "ops secret", key: "ops", allowed: []string{ScopeRecognize, ScopeEnroll, ScopeAdmin}},
+		{name: "unknown key", presented: "guess"},
+		{name: "prefix of a key", presented: "ha"},
+		{name: "empty key", presented: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, ok := keys.Authenticate(test.presented)
+			if ok != (test.key != "") || key.Name != test.key {
+				t.Fatalf("expected key %q, got %q (%t)", test.key, key.Name, ok)
+			}
+			for _, scope := range test.allowed {
+				if !key.Allows(scope) {
+					t.Errorf("expected key %s to allow %s", key.Name, scope)
+				}
+			}
+			for _, scope := range test.denied {
+				if key.Allows(scope) {
+					t.Errorf("expected key %s not to allow %s", key.Name, scope)
+				}
+			}
+		})
+	}
+}
@@ -2,16 +2,129 @@ package aws
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/adutchak/recognizer/pkg/config"
+	"github.com/adutchak/recognizer/pkg/logging"
 )
 
-func GetRekognitionClient() (*rekognition.Client, error) {
-	defaultConfig, err := config.LoadDefaultConfig(context.TODO())
+const assumeRoleSessionName = "recognizer"
+
+func GetRekognitionClient(configuration *config.Config) (*rekognition.Client, error) {
+	ctx := context.TODO()
+	awsConfig, err := loadAwsConfig(ctx, configuration)
 	if err != nil {
 		return nil, err
 	}
-	client := rekognition.NewFromConfig(defaultConfig)
+	if configuration.AwsVerifyCredentials {
+		if err := verifyIdentity(ctx, awsConfig, configuration); err != nil {
+			return nil, err
+		}
+	}
+	client := rekognition.NewFromConfig(awsConfig, func(o *rekognition.Options) {
+		if configuration.AwsEndpointUrl != "" {
+			o.BaseEndpoint = awssdk.String(configuration.AwsEndpointUrl)
+		}
+	})
 	return client, nil
 }
+
+func loadAwsConfig(ctx context.Context, configuration *config.Config) (awssdk.Config, error) {
+	// retries are performed by the recognizer itself, see resilience package
+	loadOptions := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRetryMaxAttempts(1),
+	}
+	if configuration.AwsRegion != "" {
+		loadOptions = append(loadOptions, awsconfig.WithRegion(configuration.AwsRegion))
+	}
+	if configuration.AwsProfile != "" {
+		loadOptions = append(loadOptions, awsconfig.WithSharedConfigProfile(configuration.AwsProfile))
+	}
+	if configuration.AwsAccessKeyIdFile != "" || configuration.AwsSecretAccessKeyFile != "" {
+		provider, err := getStaticCredentialsProvider(configuration)
+		if err != nil {
+			return awssdk.Config{}, err
+		}
+		loadOptions = append(loadOptions, awsconfig.WithCredentialsProvider(provider))
+	}
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return awssdk.Config{}, err
+	}
+
+	if configuration.AwsAssumeRoleArn != "" {
+		stsClient := getStsClient(awsConfig, configuration)
+		provider := stscreds.NewAssumeRoleProvider(stsClient, configuration.AwsAssumeRoleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = assumeRoleSessionName
+			if configuration.AwsAssumeRoleExternalId != "" {
+				o.ExternalID = awssdk.String(configuration.AwsAssumeRoleExternalId)
+			}
+		})
+		awsConfig.Credentials = awssdk.NewCredentialsCache(provider)
+	}
+	return awsConfig, nil
+}
+
+// getStaticCredentialsProvider reads credentials from files, i.e. docker or kubernetes secrets
+func getStaticCredentialsProvider(configuration *config.Config) (awssdk.CredentialsProvider, error) {
+	if configuration.AwsAccessKeyIdFile == "" || configuration.AwsSecretAccessKeyFile == "" {
+		return nil, fmt.Errorf("both %s and %s should be specified", config.AwsAccessKeyIdFileKey, config.AwsSecretAccessKeyFileKey)
+	}
+	accessKeyId, err := readSecretFile(configuration.AwsAccessKeyIdFile)
+	if err != nil {
+		return nil, err
+	}
+	secretAccessKey, err := readSecretFile(configuration.AwsSecretAccessKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	sessionToken := ""
+	if configuration.AwsSessionTokenFile != "" {
+		sessionToken, err = readSecretFile(configuration.AwsSessionTokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return credentials.NewStaticCredentialsProvider(accessKeyId, secretAccessKey, sessionToken), nil
+}
+
+func readSecretFile(filename string) (string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("cannot read credentials file %s: %w", filename, err)
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", fmt.Errorf("credentials file %s is empty", filename)
+	}
+	return secret, nil
+}
+
+func getStsClient(awsConfig awssdk.Config, configuration *config.Config) *sts.Client {
+	return sts.NewFromConfig(awsConfig, func(o *sts.Options) {
+		if configuration.AwsEndpointUrl != "" {
+			o.BaseEndpoint = awssdk.String(configuration.AwsEndpointUrl)
+		}
+	})
+}
+
+// verifyIdentity makes sure that the credentials are valid, GetCallerIdentity does not require any permissions
+func verifyIdentity(ctx context.Context, awsConfig awssdk.Config, configuration *config.Config) error {
+	log := logging.WithContext(ctx)
+	output, err := getStsClient(awsConfig, configuration).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("cannot verify AWS credentials: %w", err)
+	}
+	log.Infof("Using AWS identity %s in region %s", awssdk.ToString(output.Arn), awsConfig.Region)
+	return nil
+}
@@ -0,0 +1,53 @@
+package broadcast
+
+import "sync"
+
+// Hub delivers messages to all the current subscribers, a subscriber which does not keep up misses messages,
+// so that a slow consumer never delays the others
+type Hub struct {
+	lock        sync.Mutex
+	subscribers map[chan []byte]struct{}
+	buffer      int
+}
+
+// New creates a hub which keeps up to buffer undelivered messages for every subscriber
+func New(buffer int) *Hub {
+	return &Hub{subscribers: map[chan []byte]struct{}{}, buffer: buffer}
+}
+
+// Subscribe returns the channel of the messages and the function which stops the subscription and closes the channel
+func (h *Hub) Subscribe() (<-chan []byte, func()) {
+	messages := make(chan []byte, h.buffer)
+	h.lock.Lock()
+	h.subscribers[messages] = struct{}{}
+	h.lock.Unlock()
+
+	var once sync.Once
+	return messages, func() {
+		once.Do(func() {
+			h.lock.Lock()
+			delete(h.subscribers, messages)
+			h.lock.Unlock()
+			close(messages)
+		})
+	}
+}
+
+// Publish sends the message to the subscribers without waiting for them
+func (h *Hub) Publish(message []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+		}
+	}
+}
+
+// Subscribers counts the current subscribers
+func (h *Hub) Subscribers() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subscribers)
+}
@@ -0,0 +1,219 @@
+package capturestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+var ErrNotFound = errors.New("not found")
+
+const (
+	idLayout     = "20060102-150405.000000000"
+	snapshotFile = "snapshot.jpg"
+	metadataFile = "capture.json"
+)
+
+// validId makes sure that ids coming from requests cannot point outside the captures directory
+var validId = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}\.[0-9]{9}(-[0-9]+)?$`)
+
+// Store keeps the most recent captures in a directory: every capture is a subdirectory with the snapshot,
+// the crops of the faces and the metadata
+type Store struct {
+	dir string
+	max int
+	// lock serializes saving and pruning
+	lock sync.Mutex
+}
+
+type Capture struct {
+	Id     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Faces  []Face    `json:"faces"`
+}
+
+type Face struct {
+	Index       int               `json:"index"`
+	BoundingBox types.BoundingBox `json:"boundingBox"`
+	Status      string            `json:"status"`
+	// Image is the file name of the crop within the capture
+	Image string `json:"image"`
+	// Content is the crop to save, it is not stored in the metadata
+	Content []byte `json:"-"`
+}
+
+func New(dir string, max int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create captures directory: %w", err)
+	}
+	return &Store{dir: filepath.Clean(dir), max: max}, nil
+}
+
+// Save stores the snapshot with the crops of the faces and removes the oldest captures over the limit,
+// the capture is written to a hidden directory first, so that it is never listed partially
+func (s *Store) Save(source string, snapshot []byte, faces []Face) (Capture, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now().UTC()
+	capture := Capture{Id: s.newId(now), Time: now, Source: source, Faces: make([]Face, 0, len(faces))}
+	temporary, err := os.MkdirTemp(s.dir, ".capture-*")
+	if err != nil {
+		return Capture{}, err
+	}
+	defer os.RemoveAll(temporary)
+
+	if err := os.WriteFile(filepath.Join(temporary, snapshotFile), snapshot, 0o644); err != nil {
+		return Capture{}, err
+	}
+	for _, face := range faces {
+		face.Image = fmt.Sprintf("face-%d.jpg", face.Index)
+		if err := os.WriteFile(filepath.Join(temporary, face.Image), face.Content, 0o644); err != nil {
+			return Capture{}, err
+		}
+		face.Content = nil
+		capture.Faces = append(capture.Faces, face)
+	}
+	metadata, err := json.MarshalIndent(capture, "", "  ")
+	if err != nil {
+		return Capture{}, err
+	}
+	if err := os.WriteFile(filepath.Join(temporary, metadataFile), metadata, 0o644); err != nil {
+		return Capture{}, err
+	}
+	if err := os.Rename(temporary, filepath.Join(s.dir, capture.Id)); err != nil {
+		return Capture{}, err
+	}
+	return capture, s.prune()
+}
+
+// List returns the captures, the most recent first
+func (s *Store) List() ([]Capture, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	captures := make([]Capture, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		capture, err := s.Get(ids[i])
+		// the capture may be pruned meanwhile
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		captures = append(captures, capture)
+	}
+	return captures, nil
+}
+
+func (s *Store) Get(id string) (Capture, error) {
+	if !validId.MatchString(id) {
+		return Capture{}, fmt.Errorf("capture %s %w", id, ErrNotFound)
+	}
+	content, err := os.ReadFile(filepath.Join(s.dir, id, metadataFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return Capture{}, fmt.Errorf("capture %s %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return Capture{}, err
+	}
+	var capture Capture
+	if err := json.Unmarshal(content, &capture); err != nil {
+		return Capture{}, fmt.Errorf("cannot read capture %s: %w", id, err)
+	}
+	return capture, nil
+}
+
+// SnapshotPath is the path of the whole snapshot of the capture
+func (s *Store) SnapshotPath(id string) (string, error) {
+	if _, err := s.Get(id); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, id, snapshotFile), nil
+}
+
+// FacePath is the path of the crop of the face of the capture
+func (s *Store) FacePath(id string, index int) (string, error) {
+	capture, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	for _, face := range capture.Faces {
+		if face.Index == index {
+			return filepath.Join(s.dir, id, face.Image), nil
+		}
+	}
+	return "", fmt.Errorf("face %d of capture %s %w", index, id, ErrNotFound)
+}
+
+func (s *Store) Delete(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.dir, id))
+}
+
+// newId names the capture after its time, ids are sorted chronologically
+func (s *Store) newId(now time.Time) string {
+	id := now.Format(idLayout)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(s.dir, id)); errors.Is(err, os.ErrNotExist) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", now.Format(idLayout), i)
+	}
+}
+
+// ids lists the captures from the oldest
+func (s *Store) ids() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read captures directory: %w", err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && validId.MatchString(entry.Name()) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return less(ids[i], ids[j]) })
+	return ids, nil
+}
+
+func (s *Store) prune() error {
+	ids, err := s.ids()
+	if err != nil {
+		return err
+	}
+	for len(ids) > s.max {
+		if err := os.RemoveAll(filepath.Join(s.dir, ids[0])); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// less orders ids by time and then by the suffix added on collisions
+func less(a string, b string) bool {
+	timeA, suffixA := a[:len(idLayout)], a[len(idLayout):]
+	timeB, suffixB := b[:len(idLayout)], b[len(idLayout):]
+	if timeA != timeB {
+		return timeA < timeB
+	}
+	if len(suffixA) != len(suffixB) {
+		return len(suffixA) < len(suffixB)
+	}
+	return suffixA < suffixB
+}
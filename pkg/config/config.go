@@ -2,16 +2,26 @@ package config
 
 import (
 	"context"
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/go-playground/validator"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 
+	"github.com/adutchak/recognizer/pkg/auth"
 	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/preprocessing"
+	"github.com/adutchak/recognizer/pkg/rules"
 )
 
+// redactedValue replaces secrets in the shown configuration
+const redactedValue = "<redacted>"
+
 type Config struct {
 	DiscoveryMode             bool   `json:"discoveryMode"`
 	DiscoveryLabelsFileOutput string `json:"discoveryLabelsFileOutput"`
@@ -23,19 +33,97 @@ type Config struct {
 	MqttPassword              string `json:"mqttPassword" validate:"required"`
 	MqttRecognizedMessage     string `json:"mqttRecognizedMessage"`
 	MqttNotRecognizedMessage  string `json:"mqttNotRecognizedMessage"`
+	MqttErrorMessage          string `json:"mqttErrorMessage"`
+	MqttTailgatingMessage     string `json:"mqttTailgatingMessage"`
+	MqttEmbeddedBroker        bool   `json:"mqttEmbeddedBroker"`
+	MqttEmbeddedBrokerHost    string `json:"mqttEmbeddedBrokerHost"`
 
-	RunMode             string   `json:"runMode" validate:"oneof=file_watcher api"`
+	RunMode             string   `json:"runMode" validate:"oneof=file_watcher api enroll"`
 	TargetImagePath     string   `json:"targetImagePath"`
-	SampleImagePaths    []string `json:"sampleImagePaths" validate:"required"`
+	SampleImagePaths    []string `json:"sampleImagePaths" validate:"required_without=SampleImagesDir"`
+	SampleImagesDir     string   `json:"sampleImagesDir"`
 	SimilarityThreshold float32  `json:"similarityThreshold"`
 
+	ValidateSamples       bool    `json:"validateSamples"`
+	ValidateSamplesStrict bool    `json:"validateSamplesStrict"`
+	SampleMinBrightness   float32 `json:"sampleMinBrightness" validate:"min=0,max=100"`
+	SampleMinSharpness    float32 `json:"sampleMinSharpness" validate:"min=0,max=100"`
+
+	WatchSamples                     bool `json:"watchSamples"`
+	WatchSamplesDebounceMilliseconds int  `json:"watchSamplesDebounceMilliseconds" validate:"min=0"`
+
+	CapturesDir string `json:"capturesDir"`
+	CapturesMax int    `json:"capturesMax" validate:"min=1"`
+
+	VisitorsDir            string  `json:"visitorsDir"`
+	VisitorsCollectionId   string  `json:"visitorsCollectionId" validate:"required"`
+	VisitorsMatchThreshold float32 `json:"visitorsMatchThreshold" validate:"min=0,max=100"`
+	VisitorsFrequentVisits int     `json:"visitorsFrequentVisits" validate:"min=1"`
+	VisitorsFrequentDays   int     `json:"visitorsFrequentDays" validate:"min=1"`
+	VisitorsRetentionDays  int     `json:"visitorsRetentionDays" validate:"min=1"`
+
+	EventsDb            string `json:"eventsDb"`
+	EventsImagesDir     string `json:"eventsImagesDir"`
+	EventsRetentionDays int    `json:"eventsRetentionDays" validate:"min=1"`
+	CameraName          string `json:"cameraName"`
+
+	JobsQueueSize     int `json:"jobsQueueSize" validate:"min=1"`
+	JobsWorkers       int `json:"jobsWorkers" validate:"min=1"`
+	JobsExpiryMinutes int `json:"jobsExpiryMinutes" validate:"min=1"`
+
+	ApiKeys         []auth.Key `json:"apiKeys"`
+	CompiledApiKeys *auth.Keys `json:"-"`
+
+	ApiListenAddress       string `json:"apiListenAddress" validate:"required"`
+	ApiTlsCertFile         string `json:"apiTlsCertFile"`
+	ApiTlsKeyFile          string `json:"apiTlsKeyFile"`
+	ApiTlsClientCaFile     string `json:"apiTlsClientCaFile"`
+	ApiHttpRedirectAddress string `json:"apiHttpRedirectAddress"`
+
+	EnrollCapture string `json:"enrollCapture"`
+	EnrollPerson  string `json:"enrollPerson"`
+	EnrollFace    int    `json:"enrollFace" validate:"min=-1"`
+
+	CompareFacesParallelism int     `json:"compareFacesParallelism" validate:"min=1"`
+	MultiFacePolicy         string  `json:"multiFacePolicy" validate:"oneof=any_known all_known tailgating"`
+	FaceCropMargin          float32 `json:"faceCropMargin" validate:"min=0,max=1"`
+
+	LivenessEnabled                   bool    `json:"livenessEnabled"`
+	LivenessFrames                    int     `json:"livenessFrames" validate:"min=2"`
+	LivenessFrameIntervalMilliseconds int     `json:"livenessFrameIntervalMilliseconds" validate:"min=0"`
+	LivenessThreshold                 float32 `json:"livenessThreshold" validate:"min=0,max=1"`
+	LivenessStreamUrl                 string  `json:"livenessStreamUrl"`
+
+	AwsRegion               string `json:"awsRegion"`
+	AwsProfile              string `json:"awsProfile"`
+	AwsEndpointUrl          string `json:"awsEndpointUrl" validate:"omitempty,url"`
+	AwsAssumeRoleArn        string `json:"awsAssumeRoleArn" validate:"omitempty,startswith=arn:"`
+	AwsAssumeRoleExternalId string `json:"awsAssumeRoleExternalId"`
+	AwsAccessKeyIdFile      string `json:"awsAccessKeyIdFile"`
+	AwsSecretAccessKeyFile  string `json:"awsSecretAccessKeyFile"`
+	AwsSessionTokenFile     string `json:"awsSessionTokenFile"`
+	AwsVerifyCredentials    bool   `json:"awsVerifyCredentials"`
+
+	AwsMaxAttempts                    int `json:"awsMaxAttempts" validate:"min=1"`
+	AwsRetryBaseDelayMilliseconds     int `json:"awsRetryBaseDelayMilliseconds" validate:"min=0"`
+	AwsRetryMaxDelayMilliseconds      int `json:"awsRetryMaxDelayMilliseconds" validate:"min=0"`
+	AwsCircuitBreakerFailureThreshold int `json:"awsCircuitBreakerFailureThreshold" validate:"min=1"`
+	AwsCircuitBreakerOpenMilliseconds int `json:"awsCircuitBreakerOpenMilliseconds" validate:"min=0"`
+
 	ConfidencesNotLessThan string `json:"confidencesNotLessThan"`
 	ConfidencesNotMoreThan string `json:"confidencesNotMoreThan"`
 
+	ConfidencesNotLessThanMissing string `json:"confidencesNotLessThanMissing" validate:"oneof=fail pass"`
+
 	TargetImageVerifyEveryMilliseconds int `json:"targetImageVerifyEveryMilliseconds"`
 
-	ConfidencesNotLessThanNormalized map[string]string `json:"confidencesNotLessThanNormalized"`
-	ConfidencesNotMoreThanNormalized map[string]string `json:"confidencesNotMoreThanNormalized"`
+	LabelRules         rules.LabelRule  `json:"labelRules"`
+	CompiledLabelRules rules.LabelRules `json:"-"`
+
+	FaceRules         rules.FaceRule   `json:"faceRules"`
+	CompiledFaceRules *rules.FaceRules `json:"-"`
+
+	Preprocessing []preprocessing.Step `json:"preprocessing"`
 }
 
 func NewConfig() (*Config, error) {
@@ -81,40 +169,118 @@ func Parse(args []string) (*Config, error) {
 		MqttPassword:             v.GetString(MqttPasswordKey),
 		MqttRecognizedMessage:    v.GetString(MqttRecognizedMessageKey),
 		MqttNotRecognizedMessage: v.GetString(MqttNotRecognizedMessageKey),
+		MqttErrorMessage:         v.GetString(MqttErrorMessageKey),
+		MqttTailgatingMessage:    v.GetString(MqttTailgatingMessageKey),
+		MqttEmbeddedBroker:       v.GetBool(MqttEmbeddedBrokerKey),
+		MqttEmbeddedBrokerHost:   v.GetString(MqttEmbeddedBrokerHostKey),
 
 		TargetImagePath:                    v.GetString(TargetImagePathKey),
 		SampleImagePaths:                   v.GetStringSlice(SampleImagePathsKey),
+		SampleImagesDir:                    v.GetString(SampleImagesDirKey),
 		SimilarityThreshold:                float32(v.GetFloat64(SimilarityThresholdKey)),
+		ValidateSamples:                    v.GetBool(ValidateSamplesKey),
+		ValidateSamplesStrict:              v.GetBool(ValidateSamplesStrictKey),
+		SampleMinBrightness:                float32(v.GetFloat64(SampleMinBrightnessKey)),
+		SampleMinSharpness:                 float32(v.GetFloat64(SampleMinSharpnessKey)),
+		WatchSamples:                       v.GetBool(WatchSamplesKey),
+		WatchSamplesDebounceMilliseconds:   v.GetInt(WatchSamplesDebounceMillisecondsKey),
+		CapturesDir:                        v.GetString(CapturesDirKey),
+		CapturesMax:                        v.GetInt(CapturesMaxKey),
+		VisitorsDir:                        v.GetString(VisitorsDirKey),
+		VisitorsCollectionId:               v.GetString(VisitorsCollectionIdKey),
+		VisitorsMatchThreshold:             float32(v.GetFloat64(VisitorsMatchThresholdKey)),
+		VisitorsFrequentVisits:             v.GetInt(VisitorsFrequentVisitsKey),
+		VisitorsFrequentDays:               v.GetInt(VisitorsFrequentDaysKey),
+		VisitorsRetentionDays:              v.GetInt(VisitorsRetentionDaysKey),
+		EventsDb:                           v.GetString(EventsDbKey),
+		EventsImagesDir:                    v.GetString(EventsImagesDirKey),
+		EventsRetentionDays:                v.GetInt(EventsRetentionDaysKey),
+		CameraName:                         v.GetString(CameraNameKey),
+		JobsQueueSize:                      v.GetInt(JobsQueueSizeKey),
+		JobsWorkers:                        v.GetInt(JobsWorkersKey),
+		JobsExpiryMinutes:                  v.GetInt(JobsExpiryMinutesKey),
+		ApiListenAddress:                   v.GetString(ApiListenAddressKey),
+		ApiTlsCertFile:                     v.GetString(ApiTlsCertFileKey),
+		ApiTlsKeyFile:                      v.GetString(ApiTlsKeyFileKey),
+		ApiTlsClientCaFile:                 v.GetString(ApiTlsClientCaFileKey),
+		ApiHttpRedirectAddress:             v.GetString(ApiHttpRedirectAddressKey),
+		EnrollCapture:                      v.GetString(EnrollCaptureKey),
+		EnrollPerson:                       v.GetString(EnrollPersonKey),
+		EnrollFace:                         v.GetInt(EnrollFaceKey),
+		CompareFacesParallelism:            v.GetInt(CompareFacesParallelismKey),
+		MultiFacePolicy:                    v.GetString(MultiFacePolicyKey),
+		FaceCropMargin:                     float32(v.GetFloat64(FaceCropMarginKey)),
+		LivenessEnabled:                    v.GetBool(LivenessEnabledKey),
+		LivenessFrames:                     v.GetInt(LivenessFramesKey),
+		LivenessFrameIntervalMilliseconds:  v.GetInt(LivenessFrameIntervalMillisecondsKey),
+		LivenessThreshold:                  float32(v.GetFloat64(LivenessThresholdKey)),
+		LivenessStreamUrl:                  v.GetString(LivenessStreamUrlKey),
+		AwsRegion:                          v.GetString(AwsRegionKey),
+		AwsProfile:                         v.GetString(AwsProfileKey),
+		AwsEndpointUrl:                     v.GetString(AwsEndpointUrlKey),
+		AwsAssumeRoleArn:                   v.GetString(AwsAssumeRoleArnKey),
+		AwsAssumeRoleExternalId:            v.GetString(AwsAssumeRoleExternalIdKey),
+		AwsAccessKeyIdFile:                 v.GetString(AwsAccessKeyIdFileKey),
+		AwsSecretAccessKeyFile:             v.GetString(AwsSecretAccessKeyFileKey),
+		AwsSessionTokenFile:                v.GetString(AwsSessionTokenFileKey),
+		AwsVerifyCredentials:               v.GetBool(AwsVerifyCredentialsKey),
+		AwsMaxAttempts:                     v.GetInt(AwsMaxAttemptsKey),
+		AwsRetryBaseDelayMilliseconds:      v.GetInt(AwsRetryBaseDelayMillisecondsKey),
+		AwsRetryMaxDelayMilliseconds:       v.GetInt(AwsRetryMaxDelayMillisecondsKey),
+		AwsCircuitBreakerFailureThreshold:  v.GetInt(AwsCircuitBreakerFailureThresholdKey),
+		AwsCircuitBreakerOpenMilliseconds:  v.GetInt(AwsCircuitBreakerOpenMillisecondsKey),
 		ConfidencesNotLessThan:             v.GetString(ConfidencesNotLessThanKey),
 		ConfidencesNotMoreThan:             v.GetString(ConfidencesNotMoreThanKey),
+		ConfidencesNotLessThanMissing:      v.GetString(ConfidencesNotLessThanMissingKey),
 		DiscoveryMode:                      v.GetBool(DiscoveryModeKey),
 		DiscoveryLabelsFileOutput:          v.GetString(DiscoveryLabelsFileOutputKey),
 		TargetImageVerifyEveryMilliseconds: v.GetInt(TargetImageVerifyEveryMillisecondsKey),
 		RunMode:                            v.GetString(RunModeKey),
 	}
 
+	// with embedded broker, the recognizer connects to itself unless the broker is explicitly configured
+	if conf.MqttEmbeddedBroker && conf.MqttBroker == "" {
+		conf.MqttBroker = "127.0.0.1"
+	}
+
 	validate := validator.New()
 	if err := validate.Struct(conf); err != nil {
 		l.Fatalf("Missing required attributes %v\n", err)
 	}
-	conf.ConfidencesNotLessThanNormalized = make(map[string]string)
-	conf.ConfidencesNotMoreThanNormalized = make(map[string]string)
 
-	confidencesNotLessThan := strings.Split(conf.ConfidencesNotLessThan, ",")
-	confidencesNotMoreThan := strings.Split(conf.ConfidencesNotMoreThan, ",")
+	labelRules, err := parseLabelRules(v, conf)
+	if err != nil {
+		return nil, err
+	}
+	conf.LabelRules = labelRules
+	conf.CompiledLabelRules, err = rules.Compile(labelRules)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, label := range confidencesNotLessThan {
-		s := strings.Split(label, ":")
-		if len(s) == 2 {
-			conf.ConfidencesNotLessThanNormalized[s[0]] = s[1]
-		}
+	if err := decodeStructured(v, FaceRulesKey, &conf.FaceRules); err != nil {
+		return nil, err
 	}
-	for _, label := range confidencesNotMoreThan {
-		s := strings.Split(label, ":")
-		if len(s) == 2 {
-			conf.ConfidencesNotMoreThanNormalized[s[0]] = s[1]
-		}
+	conf.CompiledFaceRules, err = rules.CompileFaceRule(conf.FaceRules)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decodeStructured(v, PreprocessingKey, &conf.Preprocessing); err != nil {
+		return nil, err
+	}
+	if err := preprocessing.Validate(conf.Preprocessing); err != nil {
+		return nil, err
+	}
+
+	if err := decodeStructured(v, ApiKeysKey, &conf.ApiKeys); err != nil {
+		return nil, err
 	}
+	conf.CompiledApiKeys, err = auth.Compile(conf.ApiKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	if conf.DiscoveryMode {
 		l.Warn("RUNNING APPLICATION IN DISCOVERY MODE")
 	}
@@ -122,5 +288,106 @@ func Parse(args []string) (*Config, error) {
 	if conf.RunMode == "file_watcher" && len(conf.TargetImagePath) == 0 {
 		l.Fatalf("Missing required attributes %s\n", TargetImagePathKey)
 	}
+	// in file watcher mode, the snapshot is a single file, so the frames are taken from the stream
+	if conf.RunMode == "file_watcher" && conf.LivenessEnabled && conf.LivenessStreamUrl == "" {
+		return nil, fmt.Errorf("%s is required to check liveness in file_watcher mode", LivenessStreamUrlKey)
+	}
+	// the API is served over TLS with the certificate and its key, one without the other is a mistake
+	if (conf.ApiTlsCertFile == "") != (conf.ApiTlsKeyFile == "") {
+		return nil, fmt.Errorf("%s and %s are required together", ApiTlsCertFileKey, ApiTlsKeyFileKey)
+	}
+	// client certificates and redirects to HTTPS make sense only when the API is served over TLS
+	if conf.ApiTlsCertFile == "" && (conf.ApiTlsClientCaFile != "" || conf.ApiHttpRedirectAddress != "") {
+		return nil, fmt.Errorf("%s and %s require %s", ApiTlsClientCaFileKey, ApiHttpRedirectAddressKey, ApiTlsCertFileKey)
+	}
+	// enroll mode adds a face of a capture to the samples of the person and exits
+	if conf.RunMode == "enroll" && (conf.EnrollCapture == "" || conf.EnrollPerson == "" || conf.CapturesDir == "" || conf.SampleImagesDir == "") {
+		return nil, fmt.Errorf("%s, %s, %s and %s are required in enroll mode", EnrollCaptureKey, EnrollPersonKey, CapturesDirKey, SampleImagesDirKey)
+	}
 	return conf, nil
 }
+
+// Redacted returns a copy of the configuration without secrets, so that it can be shown or logged
+func (c Config) Redacted() Config {
+	redact := func(value *string) {
+		if *value != "" {
+			*value = redactedValue
+		}
+	}
+	redact(&c.MqttPassword)
+	redact(&c.AwsAssumeRoleExternalId)
+	c.LivenessStreamUrl = withoutUserinfo(c.LivenessStreamUrl)
+	c.AwsEndpointUrl = withoutUserinfo(c.AwsEndpointUrl)
+	// the keys are copied, so that the hashes of the configuration are kept
+	c.ApiKeys = append([]auth.Key(nil), c.ApiKeys...)
+	for i := range c.ApiKeys {
+		redact(&c.ApiKeys[i].Hash)
+	}
+	return c
+}
+
+// withoutUserinfo removes credentials from the URL, a URL which cannot be parsed is redacted as a whole
+func withoutUserinfo(value string) string {
+	if value == "" {
+		return value
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return redactedValue
+	}
+	parsed.User = nil
+	return parsed.String()
+}
+
+// parseLabelRules reads structured label rules, either from the config file or as YAML/JSON string,
+// and combines them with the legacy comma separated confidences
+func parseLabelRules(v *viper.Viper, conf *Config) (rules.LabelRule, error) {
+	var labelRules rules.LabelRule
+	if err := decodeStructured(v, LabelRulesKey, &labelRules); err != nil {
+		return labelRules, err
+	}
+
+	notLessThan, err := rules.ParseConfidences(conf.ConfidencesNotLessThan, true, conf.ConfidencesNotLessThanMissing)
+	if err != nil {
+		return labelRules, fmt.Errorf("cannot parse %s: %w", ConfidencesNotLessThanKey, err)
+	}
+	notMoreThan, err := rules.ParseConfidences(conf.ConfidencesNotMoreThan, false, "")
+	if err != nil {
+		return labelRules, fmt.Errorf("cannot parse %s: %w", ConfidencesNotMoreThanKey, err)
+	}
+	legacyRules := append(notLessThan, notMoreThan...)
+	if len(legacyRules) == 0 {
+		return labelRules, nil
+	}
+	if labelRules.IsEmpty() {
+		return rules.LabelRule{All: legacyRules}, nil
+	}
+	return rules.LabelRule{All: append([]rules.LabelRule{labelRules}, legacyRules...)}, nil
+}
+
+// decodeStructured decodes a structured value either from the config file or from a YAML/JSON string,
+// unknown keys are reported as errors
+func decodeStructured(v *viper.Viper, key string, result interface{}) error {
+	raw := v.Get(key)
+	if text, ok := raw.(string); ok {
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(text), &parsed); err != nil {
+			return fmt.Errorf("cannot parse %s: %w", key, err)
+		}
+		raw = parsed
+	}
+	if raw == nil {
+		return nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused: true,
+		Result:      result,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return fmt.Errorf("cannot parse %s: %w", key, err)
+	}
+	return nil
+}
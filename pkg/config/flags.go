@@ -6,35 +6,140 @@ import (
 
 const (
 	DefaultConfigFile = "config.yaml"
+
+	// MultiFacePolicyAnyKnown recognizes the snapshot when at least one of the faces is known
+	MultiFacePolicyAnyKnown = "any_known"
+	// MultiFacePolicyAllKnown recognizes the snapshot only when all the faces are known
+	MultiFacePolicyAllKnown = "all_known"
+	// MultiFacePolicyTailgating recognizes the snapshot when all the faces are known and reports known and unknown faces together as tailgating
+	MultiFacePolicyTailgating = "tailgating"
 )
 
 var DefaultConfig = Config{
 	MqttTopic:                          "enterance/recognizer",
 	SimilarityThreshold:                95,
+	ValidateSamples:                    true,
+	ValidateSamplesStrict:              false,
+	SampleMinBrightness:                20,
+	SampleMinSharpness:                 20,
+	WatchSamples:                       true,
+	WatchSamplesDebounceMilliseconds:   500,
+	CapturesMax:                        50,
+	EnrollFace:                         -1,
+	VisitorsCollectionId:               "recognizer-visitors",
+	VisitorsMatchThreshold:             90,
+	VisitorsFrequentVisits:             3,
+	VisitorsFrequentDays:               7,
+	VisitorsRetentionDays:              30,
+	EventsRetentionDays:                30,
+	JobsQueueSize:                      10,
+	JobsWorkers:                        1,
+	JobsExpiryMinutes:                  60,
+	ApiListenAddress:                   ":8082",
+	CompareFacesParallelism:            4,
+	MultiFacePolicy:                    MultiFacePolicyAnyKnown,
+	FaceCropMargin:                     0.3,
+	LivenessEnabled:                    false,
+	LivenessFrames:                     5,
+	LivenessFrameIntervalMilliseconds:  200,
+	LivenessThreshold:                  0.5,
+	AwsVerifyCredentials:               true,
+	AwsMaxAttempts:                     3,
+	AwsRetryBaseDelayMilliseconds:      200,
+	AwsRetryMaxDelayMilliseconds:       2000,
+	AwsCircuitBreakerFailureThreshold:  5,
+	AwsCircuitBreakerOpenMilliseconds:  30000,
 	MqttPort:                           1883,
 	MqttRecognizedMessage:              `{"message": "recognized"}`,
 	MqttNotRecognizedMessage:           `{"message": "not_recognized"}`,
+	MqttErrorMessage:                   `{"message": "error"}`,
+	MqttTailgatingMessage:              `{"message": "tailgating"}`,
+	MqttEmbeddedBroker:                 false,
+	MqttEmbeddedBrokerHost:             "127.0.0.1",
 	DiscoveryMode:                      false,
+	ConfidencesNotLessThanMissing:      "pass",
 	TargetImageVerifyEveryMilliseconds: 1000,
 	RunMode:                            "file_watcher",
 }
 
 func BuildFlagSet() *pflag.FlagSet {
 	fs := pflag.NewFlagSet("recognizer", pflag.ExitOnError)
+	fs.String(ConfigFileKey, DefaultConfigFile, "specifies the configuration file, looked up in the current and ./configs directories")
 	fs.String(MqttTopicKey, DefaultConfig.MqttTopic, "specifies the mqtt topic to work with")
 	fs.String(MqttBrokerKey, "", "specifies the mqtt broker to work with")
 	fs.String(MqttClientIdKey, "", "specifies the mqtt client ID")
 	fs.String(MqttUsernameKey, "", "specifies the mqtt username")
 	fs.String(MqttPasswordKey, "", "specifies the mqtt password")
+	fs.Bool(MqttEmbeddedBrokerKey, DefaultConfig.MqttEmbeddedBroker, "start an in-process mqtt broker on the mqtt port")
+	fs.String(MqttEmbeddedBrokerHostKey, DefaultConfig.MqttEmbeddedBrokerHost, "specifies the host the in-process mqtt broker listens on, 0.0.0.0 exposes it on all the network interfaces")
 	fs.Int(MqttPortKey, DefaultConfig.MqttPort, "specifies the mqtt port")
 	fs.String(MqttRecognizedMessageKey, DefaultConfig.MqttRecognizedMessage, "mqtt message for recognized event")
 	fs.String(MqttNotRecognizedMessageKey, DefaultConfig.MqttNotRecognizedMessage, "mqtt message for not recognized event")
+	fs.String(MqttErrorMessageKey, DefaultConfig.MqttErrorMessage, "mqtt message for event when recognition could not be performed")
+	fs.String(MqttTailgatingMessageKey, DefaultConfig.MqttTailgatingMessage, "mqtt message for tailgating event")
 
 	fs.String(TargetImagePathKey, "", "specifies the target image path to work with")
 	fs.StringSlice(SampleImagePathsKey, []string{}, "specifies the target image path to work with")
+	fs.String(SampleImagesDirKey, "", "specifies a directory, all the images in which are used as samples")
 	fs.Float32(SimilarityThresholdKey, DefaultConfig.SimilarityThreshold, "specifies the minimal similarity threshold")
+	fs.Bool(ValidateSamplesKey, DefaultConfig.ValidateSamples, "validate samples on startup, every sample costs a DetectFaces call")
+	fs.Bool(ValidateSamplesStrictKey, DefaultConfig.ValidateSamplesStrict, "refuse to start when some of the samples are invalid")
+	fs.Float32(SampleMinBrightnessKey, DefaultConfig.SampleMinBrightness, "specifies the minimal brightness of the face on a sample, between 0 and 100")
+	fs.Bool(WatchSamplesKey, DefaultConfig.WatchSamples, "reload samples when files in the samples directories change")
+	fs.Int(WatchSamplesDebounceMillisecondsKey, DefaultConfig.WatchSamplesDebounceMilliseconds, "specifies the delay in milliseconds after the last change before samples are reloaded")
+	fs.String(CapturesDirKey, "", "specifies a directory to keep recent unrecognized captures in, captures are not kept when empty")
+	fs.Int(CapturesMaxKey, DefaultConfig.CapturesMax, "specifies the number of unrecognized captures to keep")
+	fs.String(VisitorsDirKey, "", "specifies a directory to keep unknown visitors in, unknown faces are not clustered when empty")
+	fs.String(VisitorsCollectionIdKey, DefaultConfig.VisitorsCollectionId, "specifies the Rekognition collection to index faces of unknown visitors in")
+	fs.Float32(VisitorsMatchThresholdKey, DefaultConfig.VisitorsMatchThreshold, "specifies the minimal similarity of faces of the same unknown visitor")
+	fs.Int(VisitorsFrequentVisitsKey, DefaultConfig.VisitorsFrequentVisits, "specifies the number of visits after which an unknown visitor is frequent")
+	fs.Int(VisitorsFrequentDaysKey, DefaultConfig.VisitorsFrequentDays, "specifies the number of days in which frequent visits are counted")
+	fs.Int(VisitorsRetentionDaysKey, DefaultConfig.VisitorsRetentionDays, "specifies the number of days after which visits are forgotten")
+	fs.String(EventsDbKey, "", "specifies the SQLite database to record recognition events in, events are not recorded when empty")
+	fs.String(EventsImagesDirKey, "", "specifies a directory to archive snapshots of events in, snapshots are not archived when empty")
+	fs.Int(EventsRetentionDaysKey, DefaultConfig.EventsRetentionDays, "specifies the number of days after which events and their snapshots are removed")
+	fs.String(CameraNameKey, "", "specifies the camera name recorded with events, by default the host of the stream or the snapshot file name")
+	fs.Int(JobsQueueSizeKey, DefaultConfig.JobsQueueSize, "specifies the number of asynchronous recognitions waiting to be processed, more are rejected")
+	fs.Int(JobsWorkersKey, DefaultConfig.JobsWorkers, "specifies the number of asynchronous recognitions processed at once")
+	fs.Int(JobsExpiryMinutesKey, DefaultConfig.JobsExpiryMinutes, "specifies the number of minutes finished asynchronous recognitions are kept")
+	fs.String(ApiListenAddressKey, DefaultConfig.ApiListenAddress, "specifies the address the API server listens on")
+	fs.String(ApiTlsCertFileKey, "", "specifies the PEM certificate of the API server, the API is served over HTTPS with it, the file is reloaded when it changes")
+	fs.String(ApiTlsKeyFileKey, "", "specifies the PEM private key of the API server certificate")
+	fs.String(ApiTlsClientCaFileKey, "", "specifies the PEM CA certificates which have to sign client certificates, clients without a certificate are rejected")
+	fs.String(ApiHttpRedirectAddressKey, "", "specifies the address of a plain HTTP listener which redirects to the HTTPS API")
+	fs.String(EnrollCaptureKey, "", "specifies the capture to enroll in enroll mode")
+	fs.String(EnrollPersonKey, "", "specifies the person to enroll the capture as in enroll mode, the person is created when missing")
+	fs.Int(EnrollFaceKey, DefaultConfig.EnrollFace, "specifies the face of the capture to enroll in enroll mode, -1 takes the only unknown face")
+	fs.Float32(SampleMinSharpnessKey, DefaultConfig.SampleMinSharpness, "specifies the minimal sharpness of the face on a sample, between 0 and 100")
+	fs.Int(CompareFacesParallelismKey, DefaultConfig.CompareFacesParallelism, "specifies the maximum number of parallel CompareFaces requests")
+	fs.String(AwsRegionKey, "", "specifies the AWS region, by default the region is taken from the AWS shared config")
+	fs.String(AwsProfileKey, "", "specifies the AWS named profile from the shared config and credentials files")
+	fs.String(AwsEndpointUrlKey, "", "specifies a custom Rekognition and STS endpoint URL, i.e. LocalStack")
+	fs.String(AwsAssumeRoleArnKey, "", "specifies the ARN of an IAM role to assume before calling Rekognition")
+	fs.String(AwsAssumeRoleExternalIdKey, "", "specifies the external ID used to assume the role")
+	fs.String(AwsAccessKeyIdFileKey, "", "specifies a path to a file containing the AWS access key ID")
+	fs.String(AwsSecretAccessKeyFileKey, "", "specifies a path to a file containing the AWS secret access key")
+	fs.String(AwsSessionTokenFileKey, "", "specifies a path to a file containing the AWS session token")
+	fs.Bool(AwsVerifyCredentialsKey, DefaultConfig.AwsVerifyCredentials, "verify AWS credentials at startup by calling STS GetCallerIdentity")
+	fs.Int(AwsMaxAttemptsKey, DefaultConfig.AwsMaxAttempts, "specifies the maximum number of attempts for AWS calls failing with transient errors")
+	fs.Int(AwsRetryBaseDelayMillisecondsKey, DefaultConfig.AwsRetryBaseDelayMilliseconds, "specifies the base delay in milliseconds of the exponential backoff between AWS call attempts")
+	fs.Int(AwsRetryMaxDelayMillisecondsKey, DefaultConfig.AwsRetryMaxDelayMilliseconds, "specifies the maximum delay in milliseconds between AWS call attempts")
+	fs.Int(AwsCircuitBreakerFailureThresholdKey, DefaultConfig.AwsCircuitBreakerFailureThreshold, "specifies the number of consecutive failed AWS calls after which AWS is not called anymore for a while")
+	fs.Int(AwsCircuitBreakerOpenMillisecondsKey, DefaultConfig.AwsCircuitBreakerOpenMilliseconds, "specifies the interval in milliseconds during which AWS is not called after the circuit breaker opened")
+	fs.String(MultiFacePolicyKey, DefaultConfig.MultiFacePolicy, "specifies how snapshots with multiple faces are recognized: any_known, all_known or tailgating")
+	fs.Float32(FaceCropMarginKey, DefaultConfig.FaceCropMargin, "specifies the margin added on each side of a detected face before it is cropped, as a fraction of the face size")
+	fs.Bool(LivenessEnabledKey, DefaultConfig.LivenessEnabled, "reject static photos and screens by checking natural motion of the face on several frames")
+	fs.Int(LivenessFramesKey, DefaultConfig.LivenessFrames, "specifies the number of frames taken from the stream for the liveness check")
+	fs.Int(LivenessFrameIntervalMillisecondsKey, DefaultConfig.LivenessFrameIntervalMilliseconds, "specifies the interval in milliseconds between frames taken for the liveness check")
+	fs.Float32(LivenessThresholdKey, DefaultConfig.LivenessThreshold, "specifies the minimal liveness score between 0 and 1")
+	fs.String(LivenessStreamUrlKey, "", "specifies the stream the liveness frames are taken from in file_watcher mode")
 	fs.String(ConfidencesNotLessThanKey, "", "specifies labels whose recognized confidence should not be less than threshold, example: \"Photography:98.0,Fisheye:60.0,Computer Hardware:40.0\"")
 	fs.String(ConfidencesNotMoreThanKey, "", "specifies labels whose recognized confidence should be more than threshold, example: \"Electronics:90.0,Phone:40.0,Computer Hardware:40.0\"")
+	fs.String(ConfidencesNotLessThanMissingKey, DefaultConfig.ConfidencesNotLessThanMissing, "specifies whether a label from confidences-not-less-than which is not detected at all fails (fail) or passes (pass) the check")
+	fs.String(LabelRulesKey, "", "specifies structured label rules as YAML or JSON, see README")
+	fs.String(FaceRulesKey, "", "specifies face attribute rules as YAML or JSON, see README")
+	fs.String(PreprocessingKey, "", "specifies image preprocessing steps as YAML or JSON, see README")
+	fs.String(ApiKeysKey, "", "specifies API keys with their hashes and scopes as YAML or JSON, the API is not authenticated without keys, see README")
 	fs.String(DiscoveryLabelsFileOutputKey, "", "specifies a path to a file where discovered labels will be written")
 	fs.Bool(DiscoveryModeKey, DefaultConfig.DiscoveryMode, "mode which simply prints recognized information")
 	fs.Int(TargetImageVerifyEveryMillisecondsKey, DefaultConfig.TargetImageVerifyEveryMilliseconds, "specifies the interval in milliseconds to verify the target image")
@@ -9,14 +9,89 @@ const (
 	MqttPasswordKey             = "mqtt-password"
 	MqttRecognizedMessageKey    = "mqtt-recognized-message"
 	MqttNotRecognizedMessageKey = "mqtt-not-recognized-message"
+	MqttErrorMessageKey         = "mqtt-error-message"
+	MqttTailgatingMessageKey    = "mqtt-tailgating-message"
+	MqttEmbeddedBrokerKey       = "mqtt-embedded-broker"
+	MqttEmbeddedBrokerHostKey   = "mqtt-embedded-broker-host"
 
 	ConfigFileKey          = "config-file"
 	TargetImagePathKey     = "target-image-path"
 	SampleImagePathsKey    = "sample-image-paths"
+	SampleImagesDirKey     = "sample-images-dir"
 	SimilarityThresholdKey = "similarity-threshold"
 
+	ValidateSamplesKey       = "validate-samples"
+	ValidateSamplesStrictKey = "validate-samples-strict"
+	SampleMinBrightnessKey   = "sample-min-brightness"
+	SampleMinSharpnessKey    = "sample-min-sharpness"
+
+	WatchSamplesKey                     = "watch-samples"
+	WatchSamplesDebounceMillisecondsKey = "watch-samples-debounce-milliseconds"
+
+	CapturesDirKey = "captures-dir"
+	CapturesMaxKey = "captures-max"
+
+	VisitorsDirKey            = "visitors-dir"
+	VisitorsCollectionIdKey   = "visitors-collection-id"
+	VisitorsMatchThresholdKey = "visitors-match-threshold"
+	VisitorsFrequentVisitsKey = "visitors-frequent-visits"
+	VisitorsFrequentDaysKey   = "visitors-frequent-days"
+	VisitorsRetentionDaysKey  = "visitors-retention-days"
+
+	EventsDbKey            = "events-db"
+	EventsImagesDirKey     = "events-images-dir"
+	EventsRetentionDaysKey = "events-retention-days"
+	CameraNameKey          = "camera-name"
+
+	JobsQueueSizeKey     = "jobs-queue-size"
+	JobsWorkersKey       = "jobs-workers"
+	JobsExpiryMinutesKey = "jobs-expiry-minutes"
+
+	ApiKeysKey = "api-keys"
+
+	ApiListenAddressKey       = "api-listen-address"
+	ApiTlsCertFileKey         = "api-tls-cert-file"
+	ApiTlsKeyFileKey          = "api-tls-key-file"
+	ApiTlsClientCaFileKey     = "api-tls-client-ca-file"
+	ApiHttpRedirectAddressKey = "api-http-redirect-address"
+
+	EnrollCaptureKey = "enroll-capture"
+	EnrollPersonKey  = "enroll-person"
+	EnrollFaceKey    = "enroll-face"
+
+	CompareFacesParallelismKey = "compare-faces-parallelism"
+	MultiFacePolicyKey         = "multi-face-policy"
+	FaceCropMarginKey          = "face-crop-margin"
+
+	LivenessEnabledKey                   = "liveness-enabled"
+	LivenessFramesKey                    = "liveness-frames"
+	LivenessFrameIntervalMillisecondsKey = "liveness-frame-interval-milliseconds"
+	LivenessThresholdKey                 = "liveness-threshold"
+	LivenessStreamUrlKey                 = "liveness-stream-url"
+
+	AwsRegionKey               = "aws-region"
+	AwsProfileKey              = "aws-profile"
+	AwsEndpointUrlKey          = "aws-endpoint-url"
+	AwsAssumeRoleArnKey        = "aws-assume-role-arn"
+	AwsAssumeRoleExternalIdKey = "aws-assume-role-external-id"
+	AwsAccessKeyIdFileKey      = "aws-access-key-id-file"
+	AwsSecretAccessKeyFileKey  = "aws-secret-access-key-file"
+	AwsSessionTokenFileKey     = "aws-session-token-file"
+	AwsVerifyCredentialsKey    = "aws-verify-credentials"
+
+	AwsMaxAttemptsKey                    = "aws-max-attempts"
+	AwsRetryBaseDelayMillisecondsKey     = "aws-retry-base-delay-milliseconds"
+	AwsRetryMaxDelayMillisecondsKey      = "aws-retry-max-delay-milliseconds"
+	AwsCircuitBreakerFailureThresholdKey = "aws-circuit-breaker-failure-threshold"
+	AwsCircuitBreakerOpenMillisecondsKey = "aws-circuit-breaker-open-milliseconds"
+
 	ConfidencesNotLessThanKey = "confidences-not-less-than"
 	ConfidencesNotMoreThanKey = "confidences-not-more-than"
+	LabelRulesKey             = "label-rules"
+	FaceRulesKey              = "face-rules"
+	PreprocessingKey          = "preprocessing"
+
+	ConfidencesNotLessThanMissingKey = "confidences-not-less-than-missing"
 
 	DiscoveryModeKey                      = "discovery-mode"
 	DiscoveryLabelsFileOutputKey          = "discovery-labels-file-output"
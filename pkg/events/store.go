@@ -0,0 +1,281 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	// registers the pure Go "sqlite" driver, so that no C toolchain is needed
+	_ "modernc.org/sqlite"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// MaxLimit limits the events returned at once
+const MaxLimit = 500
+
+// Event is a single recognition
+type Event struct {
+	Id           int64              `json:"id"`
+	Time         time.Time          `json:"time"`
+	Camera       string             `json:"camera"`
+	Source       string             `json:"source"`
+	Decision     string             `json:"decision"`
+	Message      string             `json:"message,omitempty"`
+	Person       string             `json:"person,omitempty"`
+	Similarity   float32            `json:"similarity,omitempty"`
+	Labels       map[string]float32 `json:"labels"`
+	FailingRules []string           `json:"failingRules"`
+	// Faces and Liveness are the results reported by the recognizer, stored as they are
+	Faces    json.RawMessage `json:"faces,omitempty"`
+	Liveness json.RawMessage `json:"liveness,omitempty"`
+	// LatencyMilliseconds is the time from the snapshot to the decision
+	LatencyMilliseconds int64  `json:"latencyMilliseconds"`
+	ImagePath           string `json:"-"`
+}
+
+// migrations are applied in order, every migration runs once, applied migrations must never be changed
+var migrations = []string{
+	`CREATE TABLE events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		camera TEXT NOT NULL,
+		source TEXT NOT NULL,
+		decision TEXT NOT NULL,
+		message TEXT NOT NULL,
+		person TEXT NOT NULL,
+		similarity REAL NOT NULL,
+		labels TEXT NOT NULL,
+		failing_rules TEXT NOT NULL,
+		latency_milliseconds INTEGER NOT NULL,
+		image_path TEXT NOT NULL
+	);
+	CREATE INDEX events_time ON events (time);`,
+	`ALTER TABLE events ADD COLUMN faces TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE events ADD COLUMN liveness TEXT NOT NULL DEFAULT 'null';
+	CREATE INDEX events_camera ON events (camera, id);
+	CREATE INDEX events_person ON events (person, id);`,
+}
+
+// Filter selects events, empty fields do not filter
+type Filter struct {
+	From     time.Time
+	To       time.Time
+	Camera   string
+	Person   string
+	Decision string
+	// Before is the id of the last event of the previous page, events are returned from the most recent
+	Before int64
+	Limit  int
+}
+
+const eventColumns = `id, time, camera, source, decision, message, person, similarity, labels, failing_rules, faces, liveness, latency_milliseconds, image_path`
+
+// Store keeps events in an SQLite database
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens the database and migrates its schema to the latest version
+func Open(ctx context.Context, path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open events database: %w", err)
+	}
+	// SQLite allows a single writer, a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+	s := &Store{db: db}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("cannot create migrations table: %w", err)
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("cannot read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("events database schema version %d is newer than supported %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := s.applyMigration(ctx, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("cannot migrate events database to version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) applyMigration(ctx context.Context, version int, migration string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, migration); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied) VALUES (?, ?)`, version, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Record stores the event and returns its id
+func (s *Store) Record(ctx context.Context, event Event) (int64, error) {
+	labels, err := json.Marshal(event.Labels)
+	if err != nil {
+		return 0, err
+	}
+	failingRules, err := json.Marshal(event.FailingRules)
+	if err != nil {
+		return 0, err
+	}
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO events (time, camera, source, decision, message, person, similarity, labels, failing_rules, faces, liveness, latency_milliseconds, image_path)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Time.UnixMicro(), event.Camera, event.Source, event.Decision, event.Message, event.Person, event.Similarity,
+		string(labels), string(failingRules), rawOrNull(event.Faces), rawOrNull(event.Liveness), event.LatencyMilliseconds, event.ImagePath,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("cannot record event: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// Prune removes the events before the time and returns the archived images of the removed events
+func (s *Store) Prune(ctx context.Context, before time.Time) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT image_path FROM events WHERE time < ? AND image_path != ''`, before.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM events WHERE time < ?`, before.UnixMicro()); err != nil {
+		return nil, err
+	}
+	return images, tx.Commit()
+}
+
+// Query returns the events matching the filter, the most recent first
+func (s *Store) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if !filter.From.IsZero() {
+		add("time >= ?", filter.From.UnixMicro())
+	}
+	if !filter.To.IsZero() {
+		add("time < ?", filter.To.UnixMicro())
+	}
+	if filter.Camera != "" {
+		add("camera = ?", filter.Camera)
+	}
+	if filter.Person != "" {
+		add("person = ?", filter.Person)
+	}
+	if filter.Decision != "" {
+		add("decision = ?", filter.Decision)
+	}
+	if filter.Before > 0 {
+		add("id < ?", filter.Before)
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	query := `SELECT ` + eventColumns + ` FROM events`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query events: %w", err)
+	}
+	defer rows.Close()
+	result := []Event{}
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
+
+// Get finds the event by id
+func (s *Store) Get(ctx context.Context, id int64) (Event, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+eventColumns+` FROM events WHERE id = ?`, id)
+	event, err := scanEvent(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Event{}, fmt.Errorf("event %d %w", id, ErrNotFound)
+	}
+	return event, err
+}
+
+func scanEvent(row interface{ Scan(...interface{}) error }) (Event, error) {
+	var event Event
+	var micros int64
+	var labels, failingRules, faces, liveness string
+	err := row.Scan(&event.Id, &micros, &event.Camera, &event.Source, &event.Decision, &event.Message, &event.Person,
+		&event.Similarity, &labels, &failingRules, &faces, &liveness, &event.LatencyMilliseconds, &event.ImagePath)
+	if err != nil {
+		return Event{}, err
+	}
+	if faces != "null" {
+		event.Faces = json.RawMessage(faces)
+	}
+	if liveness != "null" {
+		event.Liveness = json.RawMessage(liveness)
+	}
+	event.Time = time.UnixMicro(micros).UTC()
+	if err := json.Unmarshal([]byte(labels), &event.Labels); err != nil {
+		return Event{}, fmt.Errorf("cannot read labels of event %d: %w", event.Id, err)
+	}
+	if err := json.Unmarshal([]byte(failingRules), &event.FailingRules); err != nil {
+		return Event{}, fmt.Errorf("cannot read failing rules of event %d: %w", event.Id, err)
+	}
+	return event, nil
+}
+
+func rawOrNull(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "null"
+	}
+	return string(raw)
+}
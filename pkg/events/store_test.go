@@ -0,0 +1,130 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Open(context.Background(), filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRecordAndGet(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+	recorded := Event{
+		Time:                time.Date(2026, 5, 1, 8, 30, 0, 123000, time.UTC),
+		Camera:              "door",
+		Source:              "api",
+		Decision:            "recognized",
+		Person:              "alice",
+		Similarity:          99.5,
+		Labels:              map[string]float32{"Person": 99},
+		FailingRules:        []string{},
+		Faces:               json.RawMessage(`[{"person":"alice"}]`),
+		LatencyMilliseconds: 420,
+		ImagePath:           "2026-05-01/1.jpg",
+	}
+	id, err := store.Record(ctx, recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := store.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded.Id = id
+	expected, _ := json.Marshal(recorded)
+	got, _ := json.Marshal(event)
+	if string(got) != string(expected) || event.ImagePath != recorded.ImagePath || event.Liveness != nil {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+	if _, err := store.Get(ctx, id+1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected event %d not to be found, got %v", id+1, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Camera: "door", Decision: "recognized", Person: "alice"},
+		{Camera: "door", Decision: "not_recognized"},
+		{Camera: "garage", Decision: "recognized", Person: "bob"},
+		{Camera: "door", Decision: "recognized", Person: "bob"},
+	}
+	for i, event := range events {
+		event.Time = start.Add(time.Duration(i) * time.Hour)
+		if _, err := store.Record(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		ids    string
+	}{
+		{name: "all, the most recent first", ids: "4,3,2,1"},
+		{name: "camera", filter: Filter{Camera: "door"}, ids: "4,2,1"},
+		{name: "person", filter: Filter{Person: "bob"}, ids: "4,3"},
+		{name: "decision", filter: Filter{Decision: "not_recognized"}, ids: "2"},
+		{name: "time range", filter: Filter{From: start.Add(time.Hour), To: start.Add(3 * time.Hour)}, ids: "3,2"},
+		{name: "page", filter: Filter{Before: 4, Limit: 2}, ids: "3,2"},
+		{name: "combined", filter: Filter{Camera: "door", Decision: "recognized"}, ids: "4,1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := store.Query(ctx, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(found))
+			for _, event := range found {
+				ids = append(ids, fmt.Sprint(event.Id))
+			}
+			if strings.Join(ids, ",") != test.ids {
+				t.Fatalf("expected events %s, got %s", test.ids, strings.Join(ids, ","))
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	store := openStore(t)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, image := range []string{"old.jpg", "", "new.jpg"} {
+		if _, err := store.Record(ctx, Event{Time: start.AddDate(0, 0, i), Decision: "recognized", ImagePath: image}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images, err := store.Prune(ctx, start.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(images, ",") != "old.jpg" {
+		t.Fatalf("expected the image of the pruned event to be returned, got %v", images)
+	}
+	remaining, err := store.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].ImagePath != "new.jpg" {
+		t.Fatalf("expected only the newest event to remain, got %+v", remaining)
+	}
+}
@@ -0,0 +1,81 @@
+package fakerekognition
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// Face is a face the fake server "sees" on an image
+type Face struct {
+	// Person identifies the face, faces of the same person match each other
+	Person string           `json:"person"`
+	Detail types.FaceDetail `json:"detail"`
+	// Unindexed faces are detected but not indexed into collections, as Rekognition does with faces of low quality
+	Unindexed bool `json:"unindexed"`
+}
+
+// Image describes how the fake server analyzes an image
+type Image struct {
+	Faces  []Face        `json:"faces"`
+	Labels []types.Label `json:"labels"`
+	// Similarity reported when a face of this image matches, defaults to 99
+	Similarity float32 `json:"similarity"`
+}
+
+// ScriptedError is returned by the fake server instead of a response
+type ScriptedError struct {
+	Operation  string `json:"operation"`
+	Code       string `json:"code"`
+	StatusCode int    `json:"statusCode"`
+	// Count is the number of calls which fail, 0 means all of them
+	Count int `json:"count"`
+}
+
+// FixtureImage is an image file along with its analysis
+type FixtureImage struct {
+	File string `json:"file"`
+	Image
+}
+
+// Fixtures is the format of fixtures file used by the standalone fake server
+type Fixtures struct {
+	Images []FixtureImage  `json:"images"`
+	Errors []ScriptedError `json:"errors"`
+}
+
+// LoadFixtures reads a JSON fixtures file, image files are relative to the fixtures file
+func LoadFixtures(s *Server, filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var fixtures Fixtures
+	if err := json.Unmarshal(content, &fixtures); err != nil {
+		return err
+	}
+	for _, fixtureImage := range fixtures.Images {
+		imagePath := fixtureImage.File
+		if !filepath.IsAbs(imagePath) {
+			imagePath = filepath.Join(filepath.Dir(filename), imagePath)
+		}
+		imageBytes, err := os.ReadFile(imagePath)
+		if err != nil {
+			return err
+		}
+		s.AddImage(imageBytes, fixtureImage.Image)
+	}
+	for _, scriptedError := range fixtures.Errors {
+		s.AddError(scriptedError)
+	}
+	return nil
+}
+
+func imageKey(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
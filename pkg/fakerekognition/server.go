@@ -0,0 +1,500 @@
+// Package fakerekognition implements a local stand-in for Amazon Rekognition which speaks the
+// Rekognition JSON protocol and answers from scripted fixtures instead of analyzing images
+package fakerekognition
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+const (
+	targetPrefix       = "RekognitionService."
+	faceModelVersion   = "7.0"
+	defaultSimilarity  = 99
+	defaultMatchLimit  = 80
+	maxImageBytes      = 5 * 1024 * 1024
+	callerIdentityArn  = "arn:aws:iam::123456789012:user/fakerekognition"
+	callerIdentityBody = `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">` +
+		`<GetCallerIdentityResult><Arn>` + callerIdentityArn + `</Arn><UserId>AIDAFAKEREKOGNITION</UserId><Account>123456789012</Account></GetCallerIdentityResult>` +
+		`<ResponseMetadata><RequestId>00000000-0000-0000-0000-000000000000</RequestId></ResponseMetadata></GetCallerIdentityResponse>`
+)
+
+type imageInput struct {
+	Bytes    []byte          `json:"Bytes"`
+	S3Object json.RawMessage `json:"S3Object"`
+}
+
+type request struct {
+	Image               *imageInput `json:"Image"`
+	SourceImage         *imageInput `json:"SourceImage"`
+	TargetImage         *imageInput `json:"TargetImage"`
+	SimilarityThreshold *float32    `json:"SimilarityThreshold"`
+	FaceMatchThreshold  *float32    `json:"FaceMatchThreshold"`
+	MinConfidence       *float32    `json:"MinConfidence"`
+	MaxFaces            *int32      `json:"MaxFaces"`
+	CollectionId        string      `json:"CollectionId"`
+	ExternalImageId     string      `json:"ExternalImageId"`
+	FaceId              string      `json:"FaceId"`
+	FaceIds             []string    `json:"FaceIds"`
+}
+
+type storedFace struct {
+	person string
+	face   types.Face
+}
+
+type apiError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func invalidParameter(message string) *apiError {
+	return &apiError{statusCode: http.StatusBadRequest, code: "InvalidParameterException", message: message}
+}
+
+// Server is a fake Rekognition API, it implements http.Handler
+type Server struct {
+	mu          sync.Mutex
+	images      map[string]Image
+	errors      []*ScriptedError
+	calls       map[string]int
+	collections map[string][]storedFace
+	lastFaceId  int
+}
+
+func New() *Server {
+	return &Server{
+		images:      make(map[string]Image),
+		calls:       make(map[string]int),
+		collections: make(map[string][]storedFace),
+	}
+}
+
+// AddImage registers the analysis returned for the image with exactly these bytes,
+// unknown images have neither faces nor labels
+func (s *Server) AddImage(content []byte, image Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[imageKey(content)] = image
+}
+
+// AddError makes the next calls of the operation fail with the scripted error
+func (s *Server) AddError(scriptedError ScriptedError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if scriptedError.StatusCode == 0 {
+		scriptedError.StatusCode = http.StatusBadRequest
+	}
+	s.errors = append(s.errors, &scriptedError)
+}
+
+// Calls returns the number of received calls of the operation, including failed ones
+func (s *Server) Calls(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[operation]
+}
+
+// Reset forgets all the images, errors, calls and collections
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images = make(map[string]Image)
+	s.errors = nil
+	s.calls = make(map[string]int)
+	s.collections = make(map[string][]storedFace)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if target == "" {
+		s.serveSts(w, r)
+		return
+	}
+	operation := strings.TrimPrefix(target, targetPrefix)
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, &apiError{statusCode: http.StatusBadRequest, code: "SerializationException", message: err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[operation]++
+	if scriptedError := s.nextError(operation); scriptedError != nil {
+		writeError(w, &apiError{statusCode: scriptedError.StatusCode, code: scriptedError.Code, message: "scripted error"})
+		return
+	}
+
+	var response interface{}
+	var err *apiError
+	switch operation {
+	case "DetectFaces":
+		response, err = s.detectFaces(req)
+	case "DetectLabels":
+		response, err = s.detectLabels(req)
+	case "CompareFaces":
+		response, err = s.compareFaces(req)
+	case "CreateCollection":
+		response, err = s.createCollection(req)
+	case "DeleteCollection":
+		response, err = s.deleteCollection(req)
+	case "ListCollections":
+		response, err = s.listCollections()
+	case "IndexFaces":
+		response, err = s.indexFaces(req)
+	case "ListFaces":
+		response, err = s.listFaces(req)
+	case "DeleteFaces":
+		response, err = s.deleteFaces(req)
+	case "SearchFaces":
+		response, err = s.searchFaces(req)
+	case "SearchFacesByImage":
+		response, err = s.searchFacesByImage(req)
+	default:
+		err = &apiError{statusCode: http.StatusBadRequest, code: "UnknownOperationException", message: operation}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// serveSts answers STS GetCallerIdentity used to verify credentials
+func (s *Server) serveSts(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "GetCallerIdentity" {
+		http.Error(w, "unsupported STS action", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.calls["GetCallerIdentity"]++
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write([]byte(callerIdentityBody))
+}
+
+func (s *Server) nextError(operation string) *ScriptedError {
+	for i, scriptedError := range s.errors {
+		if scriptedError.Operation != operation {
+			continue
+		}
+		if scriptedError.Count > 0 {
+			scriptedError.Count--
+			if scriptedError.Count == 0 {
+				s.errors = append(s.errors[:i], s.errors[i+1:]...)
+			}
+		}
+		return scriptedError
+	}
+	return nil
+}
+
+func (s *Server) lookupImage(input *imageInput) (Image, *apiError) {
+	if input == nil {
+		return Image{}, invalidParameter("image is required")
+	}
+	if len(input.S3Object) > 0 {
+		return Image{}, invalidParameter("S3 objects are not supported by the fake server")
+	}
+	if len(input.Bytes) > maxImageBytes {
+		return Image{}, &apiError{statusCode: http.StatusBadRequest, code: "ImageTooLargeException", message: "image size is too large"}
+	}
+	return s.images[imageKey(input.Bytes)], nil
+}
+
+func (s *Server) detectFaces(req request) (interface{}, *apiError) {
+	image, err := s.lookupImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+	faceDetails := []types.FaceDetail{}
+	for _, face := range image.Faces {
+		faceDetails = append(faceDetails, face.Detail)
+	}
+	return map[string]interface{}{"FaceDetails": faceDetails}, nil
+}
+
+func (s *Server) detectLabels(req request) (interface{}, *apiError) {
+	image, err := s.lookupImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+	labels := []types.Label{}
+	for _, label := range image.Labels {
+		if req.MinConfidence != nil && aws.ToFloat32(label.Confidence) < *req.MinConfidence {
+			continue
+		}
+		labels = append(labels, label)
+	}
+	return map[string]interface{}{"Labels": labels, "LabelModelVersion": "3.0"}, nil
+}
+
+func (s *Server) compareFaces(req request) (interface{}, *apiError) {
+	source, err := s.lookupImage(req.SourceImage)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.lookupImage(req.TargetImage)
+	if err != nil {
+		return nil, err
+	}
+	sourceFace, ok := largestFace(source.Faces)
+	if !ok || len(target.Faces) == 0 {
+		return nil, invalidParameter("Request has invalid parameters")
+	}
+	threshold := float32(defaultMatchLimit)
+	if req.SimilarityThreshold != nil {
+		threshold = *req.SimilarityThreshold
+	}
+	similarity := similarityOf(target)
+
+	faceMatches := []types.CompareFacesMatch{}
+	unmatchedFaces := []types.ComparedFace{}
+	for _, face := range target.Faces {
+		comparedFace := types.ComparedFace{
+			BoundingBox: face.Detail.BoundingBox,
+			Confidence:  face.Detail.Confidence,
+		}
+		if face.Person != "" && face.Person == sourceFace.Person && similarity >= threshold {
+			faceMatches = append(faceMatches, types.CompareFacesMatch{
+				Face:       &comparedFace,
+				Similarity: aws.Float32(similarity),
+			})
+			continue
+		}
+		unmatchedFaces = append(unmatchedFaces, comparedFace)
+	}
+	return map[string]interface{}{
+		"SourceImageFace": types.ComparedSourceImageFace{
+			BoundingBox: sourceFace.Detail.BoundingBox,
+			Confidence:  sourceFace.Detail.Confidence,
+		},
+		"FaceMatches":    faceMatches,
+		"UnmatchedFaces": unmatchedFaces,
+	}, nil
+}
+
+func (s *Server) createCollection(req request) (interface{}, *apiError) {
+	if _, ok := s.collections[req.CollectionId]; ok {
+		return nil, &apiError{statusCode: http.StatusBadRequest, code: "ResourceAlreadyExistsException", message: req.CollectionId}
+	}
+	s.collections[req.CollectionId] = []storedFace{}
+	return map[string]interface{}{
+		"StatusCode":       200,
+		"CollectionArn":    "aws:rekognition:us-east-1:123456789012:collection/" + req.CollectionId,
+		"FaceModelVersion": faceModelVersion,
+	}, nil
+}
+
+func (s *Server) deleteCollection(req request) (interface{}, *apiError) {
+	if _, err := s.collection(req.CollectionId); err != nil {
+		return nil, err
+	}
+	delete(s.collections, req.CollectionId)
+	return map[string]interface{}{"StatusCode": 200}, nil
+}
+
+func (s *Server) listCollections() (interface{}, *apiError) {
+	collectionIds := []string{}
+	faceModelVersions := []string{}
+	for collectionId := range s.collections {
+		collectionIds = append(collectionIds, collectionId)
+		faceModelVersions = append(faceModelVersions, faceModelVersion)
+	}
+	return map[string]interface{}{"CollectionIds": collectionIds, "FaceModelVersions": faceModelVersions}, nil
+}
+
+func (s *Server) indexFaces(req request) (interface{}, *apiError) {
+	faces, err := s.collection(req.CollectionId)
+	if err != nil {
+		return nil, err
+	}
+	image, err := s.lookupImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+	faceRecords := []types.FaceRecord{}
+	unindexedFaces := []types.UnindexedFace{}
+	for i, face := range image.Faces {
+		if req.MaxFaces != nil && i >= int(*req.MaxFaces) {
+			break
+		}
+		if face.Unindexed {
+			detail := face.Detail
+			unindexedFaces = append(unindexedFaces, types.UnindexedFace{Reasons: []types.Reason{types.ReasonLowFaceQuality}, FaceDetail: &detail})
+			continue
+		}
+		s.lastFaceId++
+		stored := storedFace{
+			person: face.Person,
+			face: types.Face{
+				FaceId:      aws.String(fmt.Sprintf("%08x-0000-4000-8000-%012x", s.lastFaceId, s.lastFaceId)),
+				ImageId:     aws.String(imageKey(req.Image.Bytes)[:36]),
+				BoundingBox: face.Detail.BoundingBox,
+				Confidence:  face.Detail.Confidence,
+			},
+		}
+		if req.ExternalImageId != "" {
+			stored.face.ExternalImageId = aws.String(req.ExternalImageId)
+		}
+		faces = append(faces, stored)
+		detail := face.Detail
+		faceRecords = append(faceRecords, types.FaceRecord{Face: &stored.face, FaceDetail: &detail})
+	}
+	s.collections[req.CollectionId] = faces
+	return map[string]interface{}{
+		"FaceRecords":      faceRecords,
+		"UnindexedFaces":   unindexedFaces,
+		"FaceModelVersion": faceModelVersion,
+	}, nil
+}
+
+func (s *Server) listFaces(req request) (interface{}, *apiError) {
+	faces, err := s.collection(req.CollectionId)
+	if err != nil {
+		return nil, err
+	}
+	result := []types.Face{}
+	for _, stored := range faces {
+		result = append(result, stored.face)
+	}
+	return map[string]interface{}{"Faces": result, "FaceModelVersion": faceModelVersion}, nil
+}
+
+func (s *Server) deleteFaces(req request) (interface{}, *apiError) {
+	faces, err := s.collection(req.CollectionId)
+	if err != nil {
+		return nil, err
+	}
+	toDelete := make(map[string]bool)
+	for _, faceId := range req.FaceIds {
+		toDelete[faceId] = true
+	}
+	remaining := []storedFace{}
+	deleted := []string{}
+	for _, stored := range faces {
+		if toDelete[aws.ToString(stored.face.FaceId)] {
+			deleted = append(deleted, aws.ToString(stored.face.FaceId))
+			continue
+		}
+		remaining = append(remaining, stored)
+	}
+	s.collections[req.CollectionId] = remaining
+	return map[string]interface{}{"DeletedFaces": deleted}, nil
+}
+
+func (s *Server) searchFaces(req request) (interface{}, *apiError) {
+	faces, err := s.collection(req.CollectionId)
+	if err != nil {
+		return nil, err
+	}
+	for _, stored := range faces {
+		if aws.ToString(stored.face.FaceId) == req.FaceId {
+			return map[string]interface{}{
+				"SearchedFaceId":   req.FaceId,
+				"FaceMatches":      s.matchFaces(faces, stored.person, req.FaceId, defaultSimilarity, req),
+				"FaceModelVersion": faceModelVersion,
+			}, nil
+		}
+	}
+	return nil, &apiError{statusCode: http.StatusBadRequest, code: "ResourceNotFoundException", message: req.FaceId}
+}
+
+func (s *Server) searchFacesByImage(req request) (interface{}, *apiError) {
+	faces, err := s.collection(req.CollectionId)
+	if err != nil {
+		return nil, err
+	}
+	image, err := s.lookupImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+	searchedFace, ok := largestFace(image.Faces)
+	if !ok {
+		return nil, invalidParameter("There are no faces in the image. Should be at least 1.")
+	}
+	return map[string]interface{}{
+		"SearchedFaceBoundingBox": searchedFace.Detail.BoundingBox,
+		"SearchedFaceConfidence":  searchedFace.Detail.Confidence,
+		"FaceMatches":             s.matchFaces(faces, searchedFace.Person, "", similarityOf(image), req),
+		"FaceModelVersion":        faceModelVersion,
+	}, nil
+}
+
+func (s *Server) matchFaces(faces []storedFace, person string, excludeFaceId string, similarity float32, req request) []types.FaceMatch {
+	threshold := float32(defaultMatchLimit)
+	if req.FaceMatchThreshold != nil {
+		threshold = *req.FaceMatchThreshold
+	}
+	faceMatches := []types.FaceMatch{}
+	if person == "" || similarity < threshold {
+		return faceMatches
+	}
+	for _, stored := range faces {
+		if stored.person != person || aws.ToString(stored.face.FaceId) == excludeFaceId {
+			continue
+		}
+		if req.MaxFaces != nil && len(faceMatches) >= int(*req.MaxFaces) {
+			break
+		}
+		face := stored.face
+		faceMatches = append(faceMatches, types.FaceMatch{Face: &face, Similarity: aws.Float32(similarity)})
+	}
+	return faceMatches
+}
+
+func (s *Server) collection(collectionId string) ([]storedFace, *apiError) {
+	faces, ok := s.collections[collectionId]
+	if !ok {
+		return nil, &apiError{statusCode: http.StatusBadRequest, code: "ResourceNotFoundException", message: "collection " + collectionId + " does not exist"}
+	}
+	return faces, nil
+}
+
+// largestFace returns the face Rekognition would choose as the source face
+func largestFace(faces []Face) (Face, bool) {
+	var largest Face
+	largestArea := float32(-1)
+	for _, face := range faces {
+		area := float32(0)
+		if box := face.Detail.BoundingBox; box != nil {
+			area = aws.ToFloat32(box.Width) * aws.ToFloat32(box.Height)
+		}
+		if area > largestArea {
+			largest = face
+			largestArea = area
+		}
+	}
+	return largest, largestArea >= 0
+}
+
+func similarityOf(image Image) float32 {
+	if image.Similarity == 0 {
+		return defaultSimilarity
+	}
+	return image.Similarity
+}
+
+func writeError(w http.ResponseWriter, err *apiError) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-ErrorType", err.code)
+	w.WriteHeader(err.statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"__type":  err.code,
+		"message": err.message,
+	})
+}
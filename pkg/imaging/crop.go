@@ -0,0 +1,81 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+	"gocv.io/x/gocv"
+)
+
+// minCropSize is the smallest side of a face crop, Rekognition does not detect faces on tiny images
+const minCropSize = 80
+
+// CropFaces cuts every face out of the encoded image and encodes the crops as JPEG,
+// bounding boxes are relative to the image size as returned by Rekognition,
+// margin enlarges every box on each side by the fraction of the box size
+func CropFaces(imageBytes []byte, boxes []types.BoundingBox, margin float32) ([][]byte, error) {
+	img, err := gocv.IMDecode(imageBytes, gocv.IMReadColor)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+	defer img.Close()
+	if img.Empty() {
+		return nil, fmt.Errorf("cannot decode image")
+	}
+
+	crops := make([][]byte, 0, len(boxes))
+	for _, box := range boxes {
+		rect := toRectangle(box, margin, img.Cols(), img.Rows())
+		if rect.Empty() {
+			return nil, fmt.Errorf("face bounding box %s is outside of the image", rect)
+		}
+		crop, err := encodeRegion(img, rect)
+		if err != nil {
+			return nil, err
+		}
+		crops = append(crops, crop)
+	}
+	return crops, nil
+}
+
+func encodeRegion(img gocv.Mat, rect image.Rectangle) ([]byte, error) {
+	region := img.Region(rect)
+	defer region.Close()
+
+	crop := region
+	// upscale small faces, i.e. people standing far from the camera
+	if shortest := min(rect.Dx(), rect.Dy()); shortest < minCropSize {
+		scale := float64(minCropSize) / float64(shortest)
+		upscaled := gocv.NewMat()
+		defer upscaled.Close()
+		gocv.Resize(region, &upscaled, image.Point{}, scale, scale, gocv.InterpolationCubic)
+		crop = upscaled
+	}
+
+	buffer, err := gocv.IMEncode(gocv.JPEGFileExt, crop)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode face crop: %w", err)
+	}
+	defer buffer.Close()
+	// the buffer is released on close, so the bytes have to be copied
+	return append([]byte(nil), buffer.GetBytes()...), nil
+}
+
+// toRectangle converts relative bounding box enlarged by the margin to pixels, clamped to the image
+func toRectangle(box types.BoundingBox, margin float32, width int, height int) image.Rectangle {
+	boxWidth := aws.ToFloat32(box.Width)
+	boxHeight := aws.ToFloat32(box.Height)
+	left := aws.ToFloat32(box.Left) - boxWidth*margin
+	top := aws.ToFloat32(box.Top) - boxHeight*margin
+	right := aws.ToFloat32(box.Left) + boxWidth*(1+margin)
+	bottom := aws.ToFloat32(box.Top) + boxHeight*(1+margin)
+	rect := image.Rect(
+		int(left*float32(width)),
+		int(top*float32(height)),
+		int(right*float32(width)),
+		int(bottom*float32(height)),
+	)
+	return rect.Intersect(image.Rect(0, 0, width, height))
+}
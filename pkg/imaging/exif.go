@@ -0,0 +1,71 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	exifOrientationTag = 0x0112
+	// orientationNormal is used when the image has no EXIF orientation
+	orientationNormal = 1
+)
+
+// exifOrientation reads the orientation tag from the EXIF segment of a JPEG image
+func exifOrientation(imageBytes []byte) int {
+	if len(imageBytes) < 4 || imageBytes[0] != 0xff || imageBytes[1] != 0xd8 {
+		return orientationNormal
+	}
+	position := 2
+	for position+4 <= len(imageBytes) {
+		if imageBytes[position] != 0xff {
+			return orientationNormal
+		}
+		marker := imageBytes[position+1]
+		length := int(binary.BigEndian.Uint16(imageBytes[position+2:]))
+		// start of scan, the metadata segments are over
+		if marker == 0xda || length < 2 || position+2+length > len(imageBytes) {
+			return orientationNormal
+		}
+		segment := imageBytes[position+4 : position+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		position += 2 + length
+	}
+	return orientationNormal
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return orientationNormal
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return orientationNormal
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return orientationNormal
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return orientationNormal
+			}
+			return orientation
+		}
+	}
+	return orientationNormal
+}
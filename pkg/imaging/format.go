@@ -0,0 +1,48 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// MaxImageBytes is the largest image Rekognition accepts as bytes
+const MaxImageBytes = 5 * 1024 * 1024
+
+// ErrInvalidImage is returned for images which cannot be recognized whatever is done with them
+var ErrInvalidImage = errors.New("invalid image")
+
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWebP Format = "webp"
+	FormatBMP  Format = "bmp"
+	FormatTIFF Format = "tiff"
+)
+
+// DetectFormat recognizes the image format by its signature
+func DetectFormat(imageBytes []byte) (Format, error) {
+	switch {
+	case bytes.HasPrefix(imageBytes, []byte{0xff, 0xd8, 0xff}):
+		return FormatJPEG, nil
+	case bytes.HasPrefix(imageBytes, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG, nil
+	case len(imageBytes) >= 12 && bytes.HasPrefix(imageBytes, []byte("RIFF")) && string(imageBytes[8:12]) == "WEBP":
+		return FormatWebP, nil
+	case bytes.HasPrefix(imageBytes, []byte("BM")):
+		return FormatBMP, nil
+	case bytes.HasPrefix(imageBytes, []byte("II*\x00")), bytes.HasPrefix(imageBytes, []byte("MM\x00*")):
+		return FormatTIFF, nil
+	}
+	if len(imageBytes) == 0 {
+		return "", fmt.Errorf("%w: the image is empty", ErrInvalidImage)
+	}
+	return "", fmt.Errorf("%w: unsupported format, expected JPEG, PNG, WebP, BMP or TIFF", ErrInvalidImage)
+}
+
+// acceptedByRekognition tells whether the format can be sent to Rekognition as is
+func acceptedByRekognition(format Format) bool {
+	return format == FormatJPEG || format == FormatPNG
+}
@@ -0,0 +1,69 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// normalizedQuality is the JPEG quality of transcoded images
+	normalizedQuality = 90
+	// maxNormalizeAttempts limits downscaling of images which still do not fit after being shrunk
+	maxNormalizeAttempts = 5
+)
+
+// Normalize makes the image acceptable by Rekognition: images in other formats than JPEG or PNG are transcoded to JPEG,
+// images larger than maxBytes are downscaled. JPEG and PNG images within the limit are returned as is
+func Normalize(imageBytes []byte, maxBytes int) ([]byte, error) {
+	format, err := DetectFormat(imageBytes)
+	if err != nil {
+		return nil, err
+	}
+	if acceptedByRekognition(format) && len(imageBytes) <= maxBytes {
+		return imageBytes, nil
+	}
+
+	// the EXIF orientation is not encoded again, so it is applied to the pixels, as CropFaces does
+	img, err := gocv.IMDecode(imageBytes, gocv.IMReadColor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decode %s image: %v", ErrInvalidImage, format, err)
+	}
+	defer func() {
+		img.Close()
+	}()
+	if img.Empty() {
+		return nil, fmt.Errorf("%w: cannot decode %s image", ErrInvalidImage, format)
+	}
+
+	for attempt := 0; attempt < maxNormalizeAttempts; attempt++ {
+		encoded, err := encodeJPEG(img)
+		if err != nil {
+			return nil, err
+		}
+		if len(encoded) <= maxBytes {
+			return encoded, nil
+		}
+		// the size of JPEG is roughly proportional to the number of pixels, shrink a bit more to not miss
+		scale := math.Sqrt(float64(maxBytes)/float64(len(encoded))) * 0.9
+		if int(float64(min(img.Cols(), img.Rows()))*scale) < minCropSize {
+			break
+		}
+		resized := gocv.NewMat()
+		gocv.Resize(img, &resized, image.Point{}, scale, scale, gocv.InterpolationArea)
+		replace(&img, resized)
+	}
+	return nil, fmt.Errorf("%w: cannot fit the %dx%d image into %d bytes", ErrInvalidImage, img.Cols(), img.Rows(), maxBytes)
+}
+
+func encodeJPEG(img gocv.Mat) ([]byte, error) {
+	buffer, err := gocv.IMEncodeWithParams(gocv.JPEGFileExt, img, []int{gocv.IMWriteJpegQuality, normalizedQuality})
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode image: %w", err)
+	}
+	defer buffer.Close()
+	// the buffer is released on close, so the bytes have to be copied
+	return append([]byte(nil), buffer.GetBytes()...), nil
+}
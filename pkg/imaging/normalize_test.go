@@ -0,0 +1,111 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	"github.com/adutchak/recognizer/pkg/preprocessing"
+)
+
+const (
+	fixtureWidth  = 240
+	fixtureHeight = 160
+	// orientationRotated90 is how phones tag portraits taken with the sensor in landscape
+	orientationRotated90 = 6
+)
+
+// rotatedJpeg is a landscape JPEG of noise, which does not compress well, with the EXIF orientation,
+// so that it has to be turned by 90 degrees to be upright
+func rotatedJpeg(t *testing.T, orientation uint16) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, fixtureWidth, fixtureHeight))
+	random := rand.New(rand.NewSource(1))
+	for x := 0; x < fixtureWidth; x++ {
+		for y := 0; y < fixtureHeight; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(random.Intn(256)), G: uint8(random.Intn(256)), B: uint8(random.Intn(256)), A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a big endian TIFF with a single IFD holding the orientation as SHORT
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = append(tiff, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xff, 0xe1}, uint16(len(segment)+2))
+
+	content := append([]byte{}, encoded.Bytes()[:2]...)
+	content = append(content, app1...)
+	content = append(content, segment...)
+	content = append(content, encoded.Bytes()[2:]...)
+	if exifOrientation(content) != int(orientation) {
+		t.Fatalf("expected the fixture to have orientation %d, got %d", orientation, exifOrientation(content))
+	}
+	return content
+}
+
+// expectSize checks the pixel size of the encoded image, the EXIF orientation is not applied by image.DecodeConfig
+func expectSize(t *testing.T, content []byte, width int, height int) {
+	t.Helper()
+	decoded, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Width != width || decoded.Height != height {
+		t.Fatalf("expected %dx%d image, got %dx%d", width, height, decoded.Width, decoded.Height)
+	}
+}
+
+func TestNormalizeAppliesExifOrientation(t *testing.T) {
+	content := rotatedJpeg(t, orientationRotated90)
+
+	// within the limit the image is sent as is, along with its EXIF orientation
+	kept, err := Normalize(content, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept, content) {
+		t.Fatal("expected the image within the limit to be kept as is")
+	}
+
+	// the noise encoded with lower quality fits into the limit without downscaling
+	normalized, err := Normalize(content, len(content)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSize(t, normalized, fixtureHeight, fixtureWidth)
+}
+
+func TestPreprocessAppliesExifOrientation(t *testing.T) {
+	enabled, disabled := true, false
+	downscale := 1000
+	tests := []struct {
+		name   string
+		steps  []preprocessing.Step
+		width  int
+		height int
+	}{
+		{name: "without exif step", steps: []preprocessing.Step{{Downscale: &downscale}}, width: fixtureHeight, height: fixtureWidth},
+		{name: "with exif step", steps: []preprocessing.Step{{ExifOrientation: &enabled}}, width: fixtureHeight, height: fixtureWidth},
+		{name: "with disabled exif step", steps: []preprocessing.Step{{ExifOrientation: &disabled}}, width: fixtureWidth, height: fixtureHeight},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			preprocessed, err := Preprocess(rotatedJpeg(t, orientationRotated90), test.steps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectSize(t, preprocessed, test.width, test.height)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"gocv.io/x/gocv"
+
+	"github.com/adutchak/recognizer/pkg/preprocessing"
+)
+
+// orientationTransforms maps EXIF orientations to the rotation and the flip restoring the upright image,
+// flipNone means no flip is needed
+var orientationTransforms = map[int]struct {
+	rotate *gocv.RotateFlag
+	flip   int
+}{
+	2: {nil, flipHorizontal},
+	3: {rotateFlag(gocv.Rotate180Clockwise), flipNone},
+	4: {nil, flipVertical},
+	// transpose
+	5: {rotateFlag(gocv.Rotate90Clockwise), flipHorizontal},
+	6: {rotateFlag(gocv.Rotate90Clockwise), flipNone},
+	// transverse
+	7: {rotateFlag(gocv.Rotate90CounterClockwise), flipHorizontal},
+	8: {rotateFlag(gocv.Rotate90CounterClockwise), flipNone},
+}
+
+const (
+	flipNone       = -2
+	flipVertical   = 0
+	flipHorizontal = 1
+)
+
+// Preprocess applies the steps one by one and encodes the result as JPEG,
+// the image is returned as is when there are no steps
+func Preprocess(imageBytes []byte, steps []preprocessing.Step) ([]byte, error) {
+	if len(steps) == 0 {
+		return imageBytes, nil
+	}
+	// the EXIF orientation is not encoded again, so it is applied to the pixels on decoding,
+	// unless the configured exif-orientation step decides whether and when it is applied
+	flags := gocv.IMReadColor
+	if hasExifOrientationStep(steps) {
+		flags |= gocv.IMReadIgnoreOrientation
+	}
+	img, err := gocv.IMDecode(imageBytes, flags)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decode image: %v", ErrInvalidImage, err)
+	}
+	defer func() {
+		img.Close()
+	}()
+	if img.Empty() {
+		return nil, fmt.Errorf("%w: cannot decode image", ErrInvalidImage)
+	}
+
+	for i, step := range steps {
+		if err := applyStep(&img, step, imageBytes); err != nil {
+			return nil, fmt.Errorf("preprocessing step %d: %w", i+1, err)
+		}
+	}
+
+	buffer, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode preprocessed image: %w", err)
+	}
+	defer buffer.Close()
+	// the buffer is released on close, so the bytes have to be copied
+	return append([]byte(nil), buffer.GetBytes()...), nil
+}
+
+func hasExifOrientationStep(steps []preprocessing.Step) bool {
+	for _, step := range steps {
+		if step.ExifOrientation != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// applyStep transforms the image either in place or by replacing it with a new one
+func applyStep(img *gocv.Mat, step preprocessing.Step, original []byte) error {
+	switch {
+	case step.ExifOrientation != nil && *step.ExifOrientation:
+		if transform, ok := orientationTransforms[exifOrientation(original)]; ok {
+			replace(img, orient(*img, transform.rotate, transform.flip))
+		}
+	case step.Rotate != nil:
+		flag := gocv.Rotate90CounterClockwise
+		switch *step.Rotate {
+		case 90:
+			flag = gocv.Rotate90Clockwise
+		case 180:
+			flag = gocv.Rotate180Clockwise
+		}
+		replace(img, orient(*img, &flag, flipNone))
+	case step.Crop != nil:
+		rect := toPixels(*step.Crop, img.Cols(), img.Rows())
+		if rect.Empty() {
+			return fmt.Errorf("crop region is empty")
+		}
+		region := img.Region(rect)
+		defer region.Close()
+		replace(img, region.Clone())
+	case step.Mask != nil:
+		gocv.Rectangle(img, toPixels(*step.Mask, img.Cols(), img.Rows()), color.RGBA{}, -1)
+	case step.Downscale != nil:
+		longest := max(img.Cols(), img.Rows())
+		if longest > *step.Downscale {
+			scale := float64(*step.Downscale) / float64(longest)
+			resized := gocv.NewMat()
+			gocv.Resize(*img, &resized, image.Point{}, scale, scale, gocv.InterpolationArea)
+			replace(img, resized)
+		}
+	case step.Denoise != nil:
+		denoised := gocv.NewMat()
+		gocv.FastNlMeansDenoisingColoredWithParams(*img, &denoised, *step.Denoise, *step.Denoise, 7, 21)
+		replace(img, denoised)
+	case step.Gamma != nil:
+		replace(img, adjustGamma(*img, *step.Gamma))
+	case step.Equalize != nil && *step.Equalize:
+		replace(img, equalize(*img))
+	}
+	return nil
+}
+
+// replace closes the image and puts the transformed one in its place
+func replace(img *gocv.Mat, transformed gocv.Mat) {
+	img.Close()
+	*img = transformed
+}
+
+func orient(img gocv.Mat, rotate *gocv.RotateFlag, flip int) gocv.Mat {
+	result := img.Clone()
+	if rotate != nil {
+		rotated := gocv.NewMat()
+		gocv.Rotate(result, &rotated, *rotate)
+		result.Close()
+		result = rotated
+	}
+	if flip != flipNone {
+		flipped := gocv.NewMat()
+		gocv.Flip(result, &flipped, flip)
+		result.Close()
+		result = flipped
+	}
+	return result
+}
+
+// adjustGamma maps every pixel value through the gamma curve using a lookup table
+func adjustGamma(img gocv.Mat, gamma float32) gocv.Mat {
+	table := gocv.NewMatWithSize(1, 256, gocv.MatTypeCV8U)
+	defer table.Close()
+	for i := 0; i < 256; i++ {
+		value := math.Pow(float64(i)/255, 1/float64(gamma)) * 255
+		table.SetUCharAt(0, i, uint8(math.Round(value)))
+	}
+	adjusted := gocv.NewMat()
+	gocv.LUT(img, table, &adjusted)
+	return adjusted
+}
+
+// equalize applies adaptive histogram equalization to the luminance only, so that colors are preserved
+func equalize(img gocv.Mat) gocv.Mat {
+	clahe := gocv.NewCLAHEWithParams(2, image.Pt(8, 8))
+	defer clahe.Close()
+
+	ycrcb := gocv.NewMat()
+	defer ycrcb.Close()
+	gocv.CvtColor(img, &ycrcb, gocv.ColorBGRToYCrCb)
+	channels := gocv.Split(ycrcb)
+	defer func() {
+		for _, channel := range channels {
+			channel.Close()
+		}
+	}()
+	luminance := gocv.NewMat()
+	clahe.Apply(channels[0], &luminance)
+	channels[0].Close()
+	channels[0] = luminance
+	gocv.Merge(channels, &ycrcb)
+
+	equalized := gocv.NewMat()
+	gocv.CvtColor(ycrcb, &equalized, gocv.ColorYCrCbToBGR)
+	return equalized
+}
+
+func toPixels(region preprocessing.Region, width int, height int) image.Rectangle {
+	rect := image.Rect(
+		int(region.Left*float32(width)),
+		int(region.Top*float32(height)),
+		int((region.Left+region.Width)*float32(width)),
+		int((region.Top+region.Height)*float32(height)),
+	)
+	return rect.Intersect(image.Rect(0, 0, width, height))
+}
+
+func rotateFlag(flag gocv.RotateFlag) *gocv.RotateFlag {
+	return &flag
+}
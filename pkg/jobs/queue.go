@@ -0,0 +1,218 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrQueueFull = errors.New("queue is full")
+)
+
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+
+	// callbackTimeout limits the time the callback URL has to accept the finished job
+	callbackTimeout = 10 * time.Second
+	// expiryInterval is how often finished jobs are checked for expiry
+	expiryInterval = time.Minute
+)
+
+// Work is the processing of a job, the result is kept even when the job fails
+type Work func(ctx context.Context) (interface{}, error)
+
+type Job struct {
+	Id       string     `json:"id"`
+	Status   string     `json:"status"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Result is the result of the work encoded as JSON
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CallbackUrl string          `json:"callbackUrl,omitempty"`
+}
+
+type queuedJob struct {
+	id   string
+	work Work
+}
+
+// Queue processes jobs in the background by a fixed number of workers, the number of waiting jobs is limited,
+// finished jobs are kept until they expire
+type Queue struct {
+	pending chan queuedJob
+	expiry  time.Duration
+	client  *http.Client
+
+	lock sync.Mutex
+	jobs map[string]*Job
+}
+
+// Start creates the queue and starts the workers, which stop along with the context
+func Start(ctx context.Context, size int, workers int, expiry time.Duration) *Queue {
+	q := &Queue{
+		pending: make(chan queuedJob, size),
+		expiry:  expiry,
+		client:  &http.Client{Timeout: callbackTimeout},
+		jobs:    map[string]*Job{},
+	}
+	for i := 0; i < workers; i++ {
+		go q.work(ctx)
+	}
+	go q.expire(ctx)
+	return q
+}
+
+// Submit queues the work, the callback URL, when set, receives the finished job
+func (q *Queue) Submit(work Work, callbackUrl string) (Job, error) {
+	id, err := newId()
+	if err != nil {
+		return Job{}, err
+	}
+	job := &Job{Id: id, Status: StatusQueued, Created: time.Now().UTC(), CallbackUrl: callbackUrl}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	select {
+	case q.pending <- queuedJob{id: id, work: work}:
+	default:
+		return Job{}, fmt.Errorf("%w, %d jobs are waiting", ErrQueueFull, cap(q.pending))
+	}
+	q.jobs[id] = job
+	return *job, nil
+}
+
+func (q *Queue) Get(id string) (Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("job %s %w", id, ErrNotFound)
+	}
+	return *job, nil
+}
+
+// Expire forgets the jobs finished before the expiry, counting back from the time
+func (q *Queue) Expire(now time.Time) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	expired := 0
+	for id, job := range q.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) >= q.expiry {
+			delete(q.jobs, id)
+			expired++
+		}
+	}
+	return expired
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case queued := <-q.pending:
+			q.run(ctx, queued)
+		}
+	}
+}
+
+func (q *Queue) run(ctx context.Context, queued queuedJob) {
+	log := logging.WithContext(ctx)
+	q.update(queued.id, func(job *Job) {
+		started := time.Now().UTC()
+		job.Status = StatusRunning
+		job.Started = &started
+	})
+
+	result, err := queued.work(ctx)
+	encoded, encodeErr := json.Marshal(result)
+	if encodeErr != nil {
+		log.Errorf("Cannot encode the result of job %s: %v", queued.id, encodeErr)
+	}
+	job := q.update(queued.id, func(job *Job) {
+		finished := time.Now().UTC()
+		job.Finished = &finished
+		job.Status = StatusDone
+		if result != nil && encodeErr == nil {
+			job.Result = encoded
+		}
+		if err != nil {
+			job.Status = StatusFailed
+			job.Error = err.Error()
+		}
+	})
+	log.Infof("Job %s is %s", job.Id, job.Status)
+	if job.CallbackUrl != "" {
+		q.callback(ctx, job)
+	}
+}
+
+// update changes the job under the lock and returns a copy of the changed job
+func (q *Queue) update(id string, change func(job *Job)) Job {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job := q.jobs[id]
+	change(job)
+	return *job
+}
+
+// callback posts the finished job to the callback URL once, failures are only logged
+func (q *Queue) callback(ctx context.Context, job Job) {
+	log := logging.WithContext(ctx)
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Errorf("Cannot encode job %s for the callback: %v", job.Id, err)
+		return
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, job.CallbackUrl, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("Cannot call back job %s: %v", job.Id, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := q.client.Do(request)
+	if err != nil {
+		log.Errorf("Cannot call back job %s: %v", job.Id, err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		log.Errorf("Callback of job %s responded with status %d", job.Id, response.StatusCode)
+	}
+}
+
+func (q *Queue) expire(ctx context.Context) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			q.Expire(now)
+		}
+	}
+}
+
+func newId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
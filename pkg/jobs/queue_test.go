@@ -0,0 +1,128 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitFinished polls the job until it is finished
+func waitFinished(t *testing.T, q *Queue, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := q.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Finished != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is not finished", id)
+	return Job{}
+}
+
+func TestQueueRunsJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := Start(ctx, 2, 1, time.Hour)
+
+	tests := []struct {
+		name   string
+		work   Work
+		status string
+		result string
+		error  string
+	}{
+		{name: "done", work: func(context.Context) (interface{}, error) { return map[string]string{"person": "alice"}, nil }, status: StatusDone, result: `{"person":"alice"}`},
+		{name: "failed with result", work: func(context.Context) (interface{}, error) {
+			return map[string]string{"person": ""}, errors.New("not recognized")
+		}, status: StatusFailed, result: `{"person":""}`, error: "not recognized"},
+		{name: "failed without result", work: func(context.Context) (interface{}, error) { return nil, errors.New("no snapshot") }, status: StatusFailed, error: "no snapshot"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			submitted, err := q.Submit(test.work, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if submitted.Status != StatusQueued {
+				t.Fatalf("expected the job to be queued, got %s", submitted.Status)
+			}
+			job := waitFinished(t, q, submitted.Id)
+			if job.Status != test.status || string(job.Result) != test.result || job.Error != test.error || job.Started == nil {
+				t.Fatalf("expected %s job with result %s and error %q, got %+v", test.status, test.result, test.error, job)
+			}
+		})
+	}
+}
+
+func TestQueueRejectsJobsWhenFull(t *testing.T) {
+	// without workers the jobs keep waiting
+	q := Start(context.Background(), 1, 0, time.Hour)
+	work := func(context.Context) (interface{}, error) { return nil, nil }
+	if _, err := q.Submit(work, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Submit(work, ""); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+	if _, err := q.Get("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected unknown job not to be found, got %v", err)
+	}
+}
+
+func TestQueueExpiresFinishedJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := Start(ctx, 1, 1, time.Minute)
+	submitted, err := q.Submit(func(context.Context) (interface{}, error) { return nil, nil }, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitFinished(t, q, submitted.Id)
+
+	if expired := q.Expire(job.Finished.Add(30 * time.Second)); expired != 0 {
+		t.Fatalf("expected no jobs to expire yet, got %d", expired)
+	}
+	if expired := q.Expire(job.Finished.Add(time.Minute)); expired != 1 {
+		t.Fatalf("expected the job to expire, got %d", expired)
+	}
+	if _, err := q.Get(submitted.Id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the expired job to be forgotten, got %v", err)
+	}
+}
+
+func TestQueueCallsBack(t *testing.T) {
+	called := make(chan Job, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var job Job
+		if err := json.NewDecoder(request.Body).Decode(&job); err != nil {
+			t.Error(err)
+		}
+		called <- job
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := Start(ctx, 1, 1, time.Hour)
+
+	submitted, err := q.Submit(func(context.Context) (interface{}, error) { return "alice", nil }, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case job := <-called:
+		if job.Id != submitted.Id || job.Status != StatusDone || string(job.Result) != `"alice"` {
+			t.Fatalf("expected the finished job to be posted, got %+v", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the callback to be called")
+	}
+}
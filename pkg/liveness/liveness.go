@@ -0,0 +1,181 @@
+package liveness
+
+import (
+	"math"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+const (
+	// fullMovementDegrees is the head rotation considered as a clearly natural movement
+	fullMovementDegrees = 8
+	// fullBlinkDrop is the relative drop of the eye aspect ratio considered as a blink
+	fullBlinkDrop = 0.4
+	// fullParallax is the change of the nose offset relative to the distance between the eyes,
+	// a flat picture keeps the offset whatever way it is moved or tilted
+	fullParallax = 0.12
+)
+
+// Result is the liveness of the face across several frames, all the scores are between 0 and 1
+type Result struct {
+	Score    float32 `json:"score"`
+	Movement float32 `json:"movement"`
+	Blink    float32 `json:"blink"`
+	Parallax float32 `json:"parallax"`
+	// Frames is the number of analyzed frames, FramesWithFace is the number of frames the face was detected on
+	Frames         int `json:"frames"`
+	FramesWithFace int `json:"framesWithFace"`
+	// MatchesSnapshot tells whether the face on the frames is the face of the snapshot,
+	// it is set only when the frames are taken apart from the snapshot
+	MatchesSnapshot *bool `json:"matchesSnapshot,omitempty"`
+}
+
+// Analyze scores natural motion of the largest face on the frames, every frame is the DetectFaces output.
+// The face is live when it blinks, or when the head turns in a way only a three dimensional head can:
+// a photo turned to the camera changes the pose as well, but without parallax, so movement counts only
+// as much as the parallax confirms it. Static photos and screens held to the camera score close to 0
+func Analyze(frames [][]types.FaceDetail) Result {
+	result := Result{Frames: len(frames)}
+	var yaws, pitches, eyes, offsets []float64
+	eyesClosed, eyesOpen := false, false
+	for _, faces := range frames {
+		face := largestFace(faces)
+		if face == nil {
+			continue
+		}
+		result.FramesWithFace++
+		if face.Pose != nil {
+			yaws = append(yaws, float64(aws.ToFloat32(face.Pose.Yaw)))
+			pitches = append(pitches, float64(aws.ToFloat32(face.Pose.Pitch)))
+		}
+		if face.EyesOpen != nil {
+			eyesOpen = eyesOpen || face.EyesOpen.Value
+			eyesClosed = eyesClosed || !face.EyesOpen.Value
+		}
+		landmarks := toPoints(face.Landmarks)
+		if ratio, ok := eyeAspectRatio(landmarks); ok {
+			eyes = append(eyes, ratio)
+		}
+		if offset, ok := noseOffset(landmarks); ok {
+			offsets = append(offsets, offset)
+		}
+	}
+	if result.FramesWithFace < 2 {
+		return result
+	}
+
+	result.Movement = saturate(math.Max(spread(yaws), spread(pitches)) / fullMovementDegrees)
+	if eyesOpen && eyesClosed {
+		result.Blink = 1
+	} else if len(eyes) > 1 {
+		lowest, highest := bounds(eyes)
+		if highest > 0 {
+			result.Blink = saturate((1 - lowest/highest) / fullBlinkDrop)
+		}
+	}
+	result.Parallax = saturate(spread(offsets) / fullParallax)
+	result.Score = float32(math.Max(float64(result.Blink), math.Min(float64(result.Movement), float64(result.Parallax))))
+	return result
+}
+
+type point struct {
+	x, y float64
+}
+
+func toPoints(landmarks []types.Landmark) map[types.LandmarkType]point {
+	points := make(map[types.LandmarkType]point, len(landmarks))
+	for _, landmark := range landmarks {
+		if landmark.X == nil || landmark.Y == nil {
+			continue
+		}
+		points[landmark.Type] = point{x: float64(*landmark.X), y: float64(*landmark.Y)}
+	}
+	return points
+}
+
+// eyeAspectRatio is the height of the eyes relative to their width, it drops when eyes close
+func eyeAspectRatio(points map[types.LandmarkType]point) (float64, bool) {
+	eyes := [][4]types.LandmarkType{
+		{types.LandmarkTypeLeftEyeUp, types.LandmarkTypeLeftEyeDown, types.LandmarkTypeLeftEyeLeft, types.LandmarkTypeLeftEyeRight},
+		{types.LandmarkTypeRightEyeUp, types.LandmarkTypeRightEyeDown, types.LandmarkTypeRightEyeLeft, types.LandmarkTypeRightEyeRight},
+	}
+	total, count := 0.0, 0
+	for _, eye := range eyes {
+		up, okUp := points[eye[0]]
+		down, okDown := points[eye[1]]
+		left, okLeft := points[eye[2]]
+		right, okRight := points[eye[3]]
+		if !okUp || !okDown || !okLeft || !okRight {
+			continue
+		}
+		width := distance(left, right)
+		if width == 0 {
+			continue
+		}
+		total += distance(up, down) / width
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return total / float64(count), true
+}
+
+// noseOffset is the horizontal position of the nose relative to the middle of the eyes,
+// in the units of the distance between the eyes
+func noseOffset(points map[types.LandmarkType]point) (float64, bool) {
+	left, okLeft := points[types.LandmarkTypeEyeLeft]
+	right, okRight := points[types.LandmarkTypeEyeRight]
+	nose, okNose := points[types.LandmarkTypeNose]
+	if !okLeft || !okRight || !okNose {
+		return 0, false
+	}
+	between := distance(left, right)
+	if between == 0 {
+		return 0, false
+	}
+	// project the nose on the line between the eyes, so that tilting the head or the picture does not count
+	middle := point{x: (left.x + right.x) / 2, y: (left.y + right.y) / 2}
+	return ((nose.x-middle.x)*(right.x-left.x) + (nose.y-middle.y)*(right.y-left.y)) / (between * between), true
+}
+
+func largestFace(faces []types.FaceDetail) *types.FaceDetail {
+	var largest *types.FaceDetail
+	largestArea := float32(-1)
+	for i := range faces {
+		box := faces[i].BoundingBox
+		if box == nil {
+			continue
+		}
+		if area := aws.ToFloat32(box.Width) * aws.ToFloat32(box.Height); area > largestArea {
+			largest, largestArea = &faces[i], area
+		}
+	}
+	return largest
+}
+
+func distance(a point, b point) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+func bounds(values []float64) (float64, float64) {
+	lowest, highest := math.Inf(1), math.Inf(-1)
+	for _, value := range values {
+		lowest = math.Min(lowest, value)
+		highest = math.Max(highest, value)
+	}
+	return lowest, highest
+}
+
+func spread(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	lowest, highest := bounds(values)
+	return highest - lowest
+}
+
+func saturate(value float64) float32 {
+	return float32(math.Min(math.Max(value, 0), 1))
+}
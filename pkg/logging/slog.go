@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Slog returns a slog logger which writes to the logger of the context, for libraries which log with slog,
+// records less severe than the level are dropped
+func Slog(ctx context.Context, level slog.Level) *slog.Logger {
+	return slog.New(&slogHandler{logger: WithContext(ctx).Desugar(), level: level})
+}
+
+// slogHandler passes slog records to zap, attributes of groups are prefixed with the group names
+type slogHandler struct {
+	logger *zap.Logger
+	level  slog.Level
+	prefix string
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level && h.logger.Core().Enabled(zapLevel(level))
+}
+
+func (h *slogHandler) Handle(_ context.Context, record slog.Record) error {
+	entry := h.logger.Check(zapLevel(record.Level), record.Message)
+	if entry == nil {
+		return nil
+	}
+	fields := make([]zap.Field, 0, record.NumAttrs())
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = appendFields(fields, h.prefix, attr)
+		return true
+	})
+	entry.Write(fields...)
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make([]zap.Field, 0, len(attrs))
+	for _, attr := range attrs {
+		fields = appendFields(fields, h.prefix, attr)
+	}
+	return &slogHandler{logger: h.logger.With(fields...), level: h.level, prefix: h.prefix}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{logger: h.logger, level: h.level, prefix: h.prefix + name + "."}
+}
+
+func appendFields(fields []zap.Field, prefix string, attr slog.Attr) []zap.Field {
+	value := attr.Value.Resolve()
+	if value.Kind() != slog.KindGroup {
+		if attr.Key == "" {
+			return fields
+		}
+		return append(fields, zap.Any(prefix+attr.Key, value.Any()))
+	}
+	// attributes of a group without a key belong to the enclosing group
+	if attr.Key != "" {
+		prefix += attr.Key + "."
+	}
+	for _, member := range value.Group() {
+		fields = appendFields(fields, prefix, member)
+	}
+	return fields
+}
+
+func zapLevel(level slog.Level) zapcore.Level {
+	switch {
+	case level >= slog.LevelError:
+		return zapcore.ErrorLevel
+	case level >= slog.LevelWarn:
+		return zapcore.WarnLevel
+	case level >= slog.LevelInfo:
+		return zapcore.InfoLevel
+	default:
+		return zapcore.DebugLevel
+	}
+}
@@ -0,0 +1,67 @@
+package mqttbroker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/adutchak/recognizer/pkg/config"
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+// Broker is an in-process MQTT broker, for installations without a separate broker and for tests
+type Broker struct {
+	server           *mqtt.Server
+	lastSubscription atomic.Int32
+}
+
+// Start starts the broker on the configured MQTT port, only clients with the recognizer credentials are allowed to connect
+func Start(ctx context.Context, configuration *config.Config) (*Broker, error) {
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       logging.Slog(ctx, slog.LevelWarn),
+	})
+
+	err := server.AddHook(new(auth.Hook), &auth.Options{
+		Ledger: &auth.Ledger{
+			Auth: auth.AuthRules{{
+				Username: auth.RString(configuration.MqttUsername),
+				Password: auth.RString(configuration.MqttPassword),
+				Allow:    true,
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{
+		ID:      "tcp",
+		Address: fmt.Sprintf("%s:%d", configuration.MqttEmbeddedBrokerHost, configuration.MqttPort),
+	})
+	if err := server.AddListener(tcp); err != nil {
+		return nil, err
+	}
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+	return &Broker{server: server}, nil
+}
+
+// Subscribe calls the handler with every message published to a topic matching the filter
+func (b *Broker) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	subscriptionId := int(b.lastSubscription.Add(1))
+	return b.server.Subscribe(filter, subscriptionId, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handler(pk.TopicName, pk.Payload)
+	})
+}
+
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
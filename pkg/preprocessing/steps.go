@@ -0,0 +1,82 @@
+package preprocessing
+
+import (
+	"fmt"
+)
+
+// Step is a single image transformation as written in the configuration, exactly one field should be set
+type Step struct {
+	// ExifOrientation rotates and flips the image as specified by the EXIF orientation tag of JPEG images
+	ExifOrientation *bool `mapstructure:"exif-orientation" json:"exifOrientation,omitempty"`
+	// Crop keeps only the region of interest
+	Crop *Region `mapstructure:"crop" json:"crop,omitempty"`
+	// Rotate rotates the image clockwise by 90, 180 or 270 degrees
+	Rotate *int `mapstructure:"rotate" json:"rotate,omitempty"`
+	// Downscale shrinks the image so that its longest side is not longer than the given number of pixels
+	Downscale *int `mapstructure:"downscale" json:"downscale,omitempty"`
+	// Denoise is the strength of the non-local means denoising, 3 removes little noise, 10 removes most of it
+	Denoise *float32 `mapstructure:"denoise" json:"denoise,omitempty"`
+	// Gamma brightens the image when above 1 and darkens it when below 1
+	Gamma *float32 `mapstructure:"gamma" json:"gamma,omitempty"`
+	// Equalize improves the contrast with adaptive histogram equalization, i.e. for night IR images
+	Equalize *bool `mapstructure:"equalize" json:"equalize,omitempty"`
+	// Mask paints the region black, i.e. neighbours' windows
+	Mask *Region `mapstructure:"mask" json:"mask,omitempty"`
+}
+
+// Region is a rectangle relative to the image size
+type Region struct {
+	Left   float32 `mapstructure:"left" json:"left"`
+	Top    float32 `mapstructure:"top" json:"top"`
+	Width  float32 `mapstructure:"width" json:"width"`
+	Height float32 `mapstructure:"height" json:"height"`
+}
+
+// Validate checks all the steps, so that a misconfigured pipeline is reported on startup
+func Validate(steps []Step) error {
+	for i, step := range steps {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("preprocessing step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s Step) validate() error {
+	set := 0
+	for _, isSet := range []bool{
+		s.ExifOrientation != nil, s.Crop != nil, s.Rotate != nil, s.Downscale != nil,
+		s.Denoise != nil, s.Gamma != nil, s.Equalize != nil, s.Mask != nil,
+	} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one transformation should be specified, got %d", set)
+	}
+
+	switch {
+	case s.Crop != nil:
+		return s.Crop.validate()
+	case s.Mask != nil:
+		return s.Mask.validate()
+	case s.Rotate != nil && *s.Rotate != 90 && *s.Rotate != 180 && *s.Rotate != 270:
+		return fmt.Errorf("rotate should be 90, 180 or 270, got %d", *s.Rotate)
+	case s.Downscale != nil && *s.Downscale < 80:
+		// Rekognition does not detect faces on tiny images
+		return fmt.Errorf("downscale should be at least 80 pixels, got %d", *s.Downscale)
+	case s.Denoise != nil && (*s.Denoise <= 0 || *s.Denoise > 30):
+		return fmt.Errorf("denoise should be between 0 and 30, got %f", *s.Denoise)
+	case s.Gamma != nil && (*s.Gamma <= 0 || *s.Gamma > 10):
+		return fmt.Errorf("gamma should be between 0 and 10, got %f", *s.Gamma)
+	}
+	return nil
+}
+
+func (r Region) validate() error {
+	if r.Left < 0 || r.Top < 0 || r.Width <= 0 || r.Height <= 0 || r.Left+r.Width > 1 || r.Top+r.Height > 1 {
+		return fmt.Errorf("region %+v should be within the image, all values are fractions of the image size", r)
+	}
+	return nil
+}
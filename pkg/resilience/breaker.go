@@ -0,0 +1,110 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+// ErrCircuitOpen is returned when calls are rejected because the circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker stops calling a failing service after a number of consecutive transient failures
+// and lets a single trial call through once the open timeout has passed
+type CircuitBreaker struct {
+	mu                  sync.Mutex
+	name                string
+	failureThreshold    int
+	openTimeout         time.Duration
+	state               circuitState
+	consecutiveFailures int
+	openedAt            time.Time
+	// trialInFlight is set while the trial call of the half-open circuit is running
+	trialInFlight bool
+}
+
+func NewCircuitBreaker(name string, failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+	}
+}
+
+// Execute calls fn unless the circuit is open, only transient errors are counted as failures,
+// cancelled calls are not counted at all
+func (b *CircuitBreaker) Execute(fn func() error) error {
+	allowed, trial := b.allow()
+	if !allowed {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	b.record(err, trial)
+	return err
+}
+
+// allow tells whether the call can be made and whether it is the trial call of the half-open circuit
+func (b *CircuitBreaker) allow() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false, false
+		}
+		b.state = circuitHalfOpen
+		logging.WithContext(context.Background()).Infof("Circuit breaker %s is half-open, trying a call", b.name)
+		b.trialInFlight = true
+		return true, true
+	case circuitHalfOpen:
+		// only one trial call at a time
+		if b.trialInFlight {
+			return false, false
+		}
+		b.trialInFlight = true
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+func (b *CircuitBreaker) record(err error, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log := logging.WithContext(context.Background())
+	if trial {
+		b.trialInFlight = false
+	}
+	// the service did not answer a cancelled call, so the call tells nothing about its health,
+	// a cancelled trial lets the next call be the trial
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if !IsTransient(err) {
+		if b.state != circuitClosed {
+			log.Infof("Circuit breaker %s is closed", b.name)
+		}
+		b.state = circuitClosed
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == circuitHalfOpen || b.consecutiveFailures >= b.failureThreshold {
+		if b.state != circuitOpen {
+			log.Warnf("Circuit breaker %s is open for %s after %d consecutive failures", b.name, b.openTimeout, b.consecutiveFailures)
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
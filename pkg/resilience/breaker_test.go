@@ -0,0 +1,81 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+const testOpenTimeout = 10 * time.Millisecond
+
+// halfOpenBreaker returns a breaker whose open timeout has just passed, so that the next call is the trial call
+func halfOpenBreaker(t *testing.T) *CircuitBreaker {
+	t.Helper()
+	breaker := NewCircuitBreaker("test", 1, testOpenTimeout)
+	if err := breaker.Execute(func() error { return io.ErrUnexpectedEOF }); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected the transient error, got %v", err)
+	}
+	if err := breaker.Execute(func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	time.Sleep(testOpenTimeout)
+	return breaker
+}
+
+func TestCircuitBreakerTrialCall(t *testing.T) {
+	tests := []struct {
+		name  string
+		trial error
+		state circuitState
+	}{
+		{name: "success closes", trial: nil, state: circuitClosed},
+		{name: "non transient error closes", trial: errors.New("invalid parameter"), state: circuitClosed},
+		{name: "transient error opens again", trial: io.ErrUnexpectedEOF, state: circuitOpen},
+		{name: "cancellation stays half-open", trial: fmt.Errorf("compare faces: %w", context.Canceled), state: circuitHalfOpen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := halfOpenBreaker(t)
+			err := breaker.Execute(func() error {
+				if err := breaker.Execute(func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+					t.Errorf("expected only one trial call at a time, got %v", err)
+				}
+				return test.trial
+			})
+			if !errors.Is(err, test.trial) {
+				t.Fatalf("expected the error of the trial call, got %v", err)
+			}
+			if breaker.state != test.state {
+				t.Fatalf("expected state %d, got %d", test.state, breaker.state)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerAllowsTrialAfterCancellation(t *testing.T) {
+	breaker := halfOpenBreaker(t)
+	if err := breaker.Execute(func() error { return context.Canceled }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation, got %v", err)
+	}
+
+	if err := breaker.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("expected the next call to be the trial call, got %v", err)
+	}
+	if breaker.state != circuitClosed {
+		t.Fatalf("expected the successful trial to close the circuit, got state %d", breaker.state)
+	}
+}
+
+func TestCircuitBreakerIgnoresCancelledCalls(t *testing.T) {
+	breaker := NewCircuitBreaker("test", 2, time.Minute)
+	breaker.Execute(func() error { return io.ErrUnexpectedEOF })
+	breaker.Execute(func() error { return context.Canceled })
+	breaker.Execute(func() error { return io.ErrUnexpectedEOF })
+
+	if breaker.state != circuitOpen {
+		t.Fatalf("expected a cancelled call not to reset consecutive failures, got state %d", breaker.state)
+	}
+}
@@ -0,0 +1,90 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+// RetryPolicy describes how transient errors are retried
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// retryableErrorCodes are AWS error codes which are worth retrying
+var retryableErrorCodes = map[string]bool{
+	"ThrottlingException":                    true,
+	"ProvisionedThroughputExceededException": true,
+	"InternalServerError":                    true,
+	"ServiceUnavailableException":            true,
+	"RequestTimeout":                         true,
+	"RequestTimeoutException":                true,
+}
+
+// Retry calls fn until it succeeds, returns a non transient error or the policy attempts are exhausted
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) error) error {
+	log := logging.WithContext(ctx)
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil || !IsTransient(err) {
+			return err
+		}
+		if attempt == policy.MaxAttempts-1 {
+			break
+		}
+		delay := backoff(policy, attempt)
+		log.Warnf("Transient error (attempt %d/%d), retrying in %s: %v", attempt+1, policy.MaxAttempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// IsTransient tells whether the error is caused by throttling, a server side fault or the network
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if retryableErrorCodes[apiErr.ErrorCode()] || apiErr.ErrorFault() == smithy.FaultServer {
+			return true
+		}
+	}
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		statusCode := responseErr.HTTPStatusCode()
+		return statusCode == 429 || statusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// backoff returns exponential delay with full jitter for the given attempt
+func backoff(policy RetryPolicy, attempt int) time.Duration {
+	delay := policy.MaxDelay
+	if attempt < 32 && policy.BaseDelay<<attempt < policy.MaxDelay {
+		delay = policy.BaseDelay << attempt
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
@@ -0,0 +1,150 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// FaceRule is a set of requirements for faces returned by DetectFaces as written in the configuration
+type FaceRule struct {
+	FaceCount     *int     `mapstructure:"face-count" json:"faceCount,omitempty"`
+	MinConfidence *float32 `mapstructure:"min-confidence" json:"minConfidence,omitempty"`
+
+	MaxYaw   *float32 `mapstructure:"max-yaw" json:"maxYaw,omitempty"`
+	MaxPitch *float32 `mapstructure:"max-pitch" json:"maxPitch,omitempty"`
+	MaxRoll  *float32 `mapstructure:"max-roll" json:"maxRoll,omitempty"`
+
+	MinBrightness *float32 `mapstructure:"min-brightness" json:"minBrightness,omitempty"`
+	MinSharpness  *float32 `mapstructure:"min-sharpness" json:"minSharpness,omitempty"`
+
+	// MinWidth and MinHeight are fractions of the image size
+	MinWidth  *float32 `mapstructure:"min-width" json:"minWidth,omitempty"`
+	MinHeight *float32 `mapstructure:"min-height" json:"minHeight,omitempty"`
+
+	EyesOpen   *bool `mapstructure:"eyes-open" json:"eyesOpen,omitempty"`
+	Sunglasses *bool `mapstructure:"sunglasses" json:"sunglasses,omitempty"`
+}
+
+// FaceRules is a compiled face rule
+type FaceRules struct {
+	rule FaceRule
+}
+
+// CompileFaceRule validates the face rule, an empty rule always passes
+func CompileFaceRule(rule FaceRule) (*FaceRules, error) {
+	if rule.FaceCount != nil && *rule.FaceCount < 1 {
+		return nil, fmt.Errorf("face-rules: face-count should be at least 1")
+	}
+	limits := []struct {
+		name  string
+		value *float32
+		max   float32
+	}{
+		{"min-confidence", rule.MinConfidence, 100},
+		{"max-yaw", rule.MaxYaw, 180},
+		{"max-pitch", rule.MaxPitch, 180},
+		{"max-roll", rule.MaxRoll, 180},
+		{"min-brightness", rule.MinBrightness, 100},
+		{"min-sharpness", rule.MinSharpness, 100},
+		{"min-width", rule.MinWidth, 1},
+		{"min-height", rule.MinHeight, 1},
+	}
+	for _, limit := range limits {
+		if limit.value != nil && (*limit.value < 0 || *limit.value > limit.max) {
+			return nil, fmt.Errorf("face-rules: %s should be between 0 and %.0f", limit.name, limit.max)
+		}
+	}
+	return &FaceRules{rule: rule}, nil
+}
+
+// NeedsAllAttributes tells whether DetectFaces should be called with ALL attributes,
+// eyes and sunglasses are not returned with the DEFAULT ones
+func (f *FaceRules) NeedsAllAttributes() bool {
+	return f.rule.EyesOpen != nil || f.rule.Sunglasses != nil
+}
+
+// Evaluate checks the number of faces and every face
+func (f *FaceRules) Evaluate(faces []types.FaceDetail) Result {
+	var result Result
+	if f.rule.FaceCount != nil && len(faces) != *f.rule.FaceCount {
+		result.Failures = append(result.Failures, fmt.Sprintf("Expected %d faces, detected %d", *f.rule.FaceCount, len(faces)))
+	}
+	for i, face := range faces {
+		result.add(f.EvaluateFace(i, face))
+	}
+	return result
+}
+
+// EvaluateFace checks a single face, index is used in failure messages
+func (f *FaceRules) EvaluateFace(index int, face types.FaceDetail) Result {
+	var result Result
+	fail := func(format string, args ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf("Face %d: ", index)+fmt.Sprintf(format, args...))
+	}
+
+	if limit := f.rule.MinConfidence; limit != nil && aws.ToFloat32(face.Confidence) < *limit {
+		fail("detection confidence %f is less than %.2f", aws.ToFloat32(face.Confidence), *limit)
+	}
+
+	if face.Pose != nil {
+		checkMaxAngle(fail, "yaw", face.Pose.Yaw, f.rule.MaxYaw)
+		checkMaxAngle(fail, "pitch", face.Pose.Pitch, f.rule.MaxPitch)
+		checkMaxAngle(fail, "roll", face.Pose.Roll, f.rule.MaxRoll)
+	} else if f.rule.MaxYaw != nil || f.rule.MaxPitch != nil || f.rule.MaxRoll != nil {
+		fail("pose is unknown")
+	}
+
+	if face.Quality != nil {
+		if limit := f.rule.MinBrightness; limit != nil && aws.ToFloat32(face.Quality.Brightness) < *limit {
+			fail("brightness %f is less than %.2f", aws.ToFloat32(face.Quality.Brightness), *limit)
+		}
+		if limit := f.rule.MinSharpness; limit != nil && aws.ToFloat32(face.Quality.Sharpness) < *limit {
+			fail("sharpness %f is less than %.2f", aws.ToFloat32(face.Quality.Sharpness), *limit)
+		}
+	} else if f.rule.MinBrightness != nil || f.rule.MinSharpness != nil {
+		fail("quality is unknown")
+	}
+
+	if box := face.BoundingBox; box != nil {
+		if limit := f.rule.MinWidth; limit != nil && aws.ToFloat32(box.Width) < *limit {
+			fail("width %f is less than %.2f of the image", aws.ToFloat32(box.Width), *limit)
+		}
+		if limit := f.rule.MinHeight; limit != nil && aws.ToFloat32(box.Height) < *limit {
+			fail("height %f is less than %.2f of the image", aws.ToFloat32(box.Height), *limit)
+		}
+	} else if f.rule.MinWidth != nil || f.rule.MinHeight != nil {
+		fail("bounding box is unknown")
+	}
+
+	if expected := f.rule.EyesOpen; expected != nil {
+		if face.EyesOpen == nil {
+			fail("eyes are unknown")
+		} else if face.EyesOpen.Value != *expected {
+			fail("eyes open is %t (%f), expected %t", face.EyesOpen.Value, aws.ToFloat32(face.EyesOpen.Confidence), *expected)
+		}
+	}
+	if expected := f.rule.Sunglasses; expected != nil {
+		if face.Sunglasses == nil {
+			fail("sunglasses are unknown")
+		} else if face.Sunglasses.Value != *expected {
+			fail("sunglasses is %t (%f), expected %t", face.Sunglasses.Value, aws.ToFloat32(face.Sunglasses.Confidence), *expected)
+		}
+	}
+	return result
+}
+
+func checkMaxAngle(fail func(format string, args ...interface{}), name string, angle *float32, limit *float32) {
+	if limit == nil {
+		return
+	}
+	if angle == nil {
+		fail("%s is unknown", name)
+		return
+	}
+	if float32(math.Abs(float64(*angle))) > *limit {
+		fail("%s %f is more than %.2f", name, *angle, *limit)
+	}
+}
@@ -0,0 +1,325 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+// LabelRule is a label rule as written in the configuration,
+// it is either a group (all/any) of rules or a check of labels selected by name, parent or category
+type LabelRule struct {
+	All []LabelRule `mapstructure:"all" json:"all,omitempty"`
+	Any []LabelRule `mapstructure:"any" json:"any,omitempty"`
+
+	Label    string `mapstructure:"label" json:"label,omitempty"`
+	Parent   string `mapstructure:"parent" json:"parent,omitempty"`
+	Category string `mapstructure:"category" json:"category,omitempty"`
+
+	Present       bool     `mapstructure:"present" json:"present,omitempty"`
+	Absent        bool     `mapstructure:"absent" json:"absent,omitempty"`
+	Missing       string   `mapstructure:"missing" json:"missing,omitempty"`
+	MinConfidence *float32 `mapstructure:"min-confidence" json:"minConfidence,omitempty"`
+	MaxConfidence *float32 `mapstructure:"max-confidence" json:"maxConfidence,omitempty"`
+}
+
+// IsEmpty tells whether the rule does not check anything
+func (r LabelRule) IsEmpty() bool {
+	return len(r.All) == 0 && len(r.Any) == 0 && r.Label == "" && r.Parent == "" && r.Category == ""
+}
+
+const (
+	// MissingFail makes a check fail when none of the selected labels was returned
+	MissingFail = "fail"
+	// MissingPass makes a check pass when none of the selected labels was returned
+	MissingPass = "pass"
+)
+
+// Result of label rules evaluation
+type Result struct {
+	// Failures are the reasons why the labels did not pass the rules
+	Failures []string
+	// MissingLabels are the required labels which were not returned at all
+	MissingLabels []string
+}
+
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+func (r *Result) add(other Result) {
+	r.Failures = append(r.Failures, other.Failures...)
+	r.MissingLabels = append(r.MissingLabels, other.MissingLabels...)
+}
+
+// LabelRules is a compiled label rule which is evaluated against labels returned by DetectLabels
+type LabelRules interface {
+	Evaluate(labels []types.Label) Result
+	String() string
+}
+
+// Compile validates the rule and prepares it for evaluation, an empty rule always passes
+func Compile(rule LabelRule) (LabelRules, error) {
+	if rule.IsEmpty() {
+		return &group{all: true}, nil
+	}
+	return compile(rule, "label-rules")
+}
+
+func compile(rule LabelRule, path string) (LabelRules, error) {
+	isGroup := len(rule.All) > 0 || len(rule.Any) > 0
+	isCheck := rule.Label != "" || rule.Parent != "" || rule.Category != ""
+	switch {
+	case isGroup && isCheck:
+		return nil, fmt.Errorf("%s: a rule should be either a group (all/any) or a label check", path)
+	case len(rule.All) > 0 && len(rule.Any) > 0:
+		return nil, fmt.Errorf("%s: a group should be either all or any", path)
+	case isGroup:
+		return compileGroup(rule, path)
+	case isCheck:
+		return compileCheck(rule, path)
+	default:
+		return nil, fmt.Errorf("%s: empty rule", path)
+	}
+}
+
+func compileGroup(rule LabelRule, path string) (LabelRules, error) {
+	g := &group{all: len(rule.All) > 0}
+	children, name := rule.All, "all"
+	if !g.all {
+		children, name = rule.Any, "any"
+	}
+	for i, child := range children {
+		compiled, err := compile(child, fmt.Sprintf("%s.%s[%d]", path, name, i))
+		if err != nil {
+			return nil, err
+		}
+		g.rules = append(g.rules, compiled)
+	}
+	return g, nil
+}
+
+func compileCheck(rule LabelRule, path string) (LabelRules, error) {
+	c := &check{missingFails: rule.Present, absent: rule.Absent, min: rule.MinConfidence, max: rule.MaxConfidence}
+	selectors := 0
+	if rule.Label != "" {
+		c.selector, c.name, selectors = selectLabel, rule.Label, selectors+1
+	}
+	if rule.Parent != "" {
+		c.selector, c.name, selectors = selectParent, rule.Parent, selectors+1
+	}
+	if rule.Category != "" {
+		c.selector, c.name, selectors = selectCategory, rule.Category, selectors+1
+	}
+	if selectors > 1 {
+		return nil, fmt.Errorf("%s: only one of label, parent and category can be set", path)
+	}
+	if c.missingFails && c.absent {
+		return nil, fmt.Errorf("%s: %s cannot be both present and absent", path, c.describe())
+	}
+	if c.absent && (c.min != nil || c.max != nil || rule.Missing != "") {
+		return nil, fmt.Errorf("%s: absent %s cannot have confidence limits or missing policy", path, c.describe())
+	}
+	switch rule.Missing {
+	case "":
+	case MissingFail:
+		c.missingFails = true
+	case MissingPass:
+		if rule.Present {
+			return nil, fmt.Errorf("%s: present %s cannot pass when missing", path, c.describe())
+		}
+	default:
+		return nil, fmt.Errorf("%s: missing of %s should be either %s or %s", path, c.describe(), MissingFail, MissingPass)
+	}
+	if !c.missingFails && !c.absent && c.min == nil && c.max == nil {
+		return nil, fmt.Errorf("%s: %s does not check anything, set present, absent or confidence limits", path, c.describe())
+	}
+	for _, limit := range []*float32{c.min, c.max} {
+		if limit != nil && (*limit < 0 || *limit > 100) {
+			return nil, fmt.Errorf("%s: confidence %.2f of %s should be between 0 and 100", path, *limit, c.describe())
+		}
+	}
+	if c.min != nil && c.max != nil && *c.min > *c.max {
+		return nil, fmt.Errorf("%s: min-confidence of %s is greater than max-confidence", path, c.describe())
+	}
+	return c, nil
+}
+
+type group struct {
+	all   bool
+	rules []LabelRules
+}
+
+func (g *group) Evaluate(labels []types.Label) Result {
+	var result Result
+	for _, rule := range g.rules {
+		ruleResult := rule.Evaluate(labels)
+		if !g.all && ruleResult.Passed() {
+			return Result{}
+		}
+		result.add(ruleResult)
+	}
+	if !g.all && len(g.rules) > 0 {
+		result.Failures = []string{fmt.Sprintf("none of %s passed: %s", g, strings.Join(result.Failures, "; "))}
+	}
+	return result
+}
+
+func (g *group) String() string {
+	rules := make([]string, 0, len(g.rules))
+	for _, rule := range g.rules {
+		rules = append(rules, rule.String())
+	}
+	operator := " OR "
+	if g.all {
+		operator = " AND "
+	}
+	return "(" + strings.Join(rules, operator) + ")"
+}
+
+type selector int
+
+const (
+	selectLabel selector = iota
+	selectParent
+	selectCategory
+)
+
+type check struct {
+	selector     selector
+	name         string
+	missingFails bool
+	absent       bool
+	min          *float32
+	max          *float32
+}
+
+func (c *check) Evaluate(labels []types.Label) Result {
+	matched := c.match(labels)
+	if c.absent {
+		if len(matched) > 0 {
+			return Result{Failures: []string{fmt.Sprintf("%s should be absent, found %s (%f)", c.describe(), aws.ToString(matched[0].Name), aws.ToFloat32(matched[0].Confidence))}}
+		}
+		return Result{}
+	}
+	if len(matched) == 0 {
+		if c.missingFails {
+			return Result{
+				Failures:      []string{fmt.Sprintf("%s should be present, but is missing", c.describe())},
+				MissingLabels: []string{c.name},
+			}
+		}
+		return Result{}
+	}
+
+	var result Result
+	for _, label := range matched {
+		confidence := aws.ToFloat32(label.Confidence)
+		if c.min != nil && confidence < *c.min {
+			result.Failures = append(result.Failures, fmt.Sprintf("Label %s has confidence less than %.2f (%f)", aws.ToString(label.Name), *c.min, confidence))
+		}
+		if c.max != nil && confidence > *c.max {
+			result.Failures = append(result.Failures, fmt.Sprintf("Label %s has confidence more than %.2f (%f)", aws.ToString(label.Name), *c.max, confidence))
+		}
+	}
+	return result
+}
+
+func (c *check) match(labels []types.Label) []types.Label {
+	var matched []types.Label
+	for _, label := range labels {
+		if c.matches(label) {
+			matched = append(matched, label)
+		}
+	}
+	return matched
+}
+
+func (c *check) matches(label types.Label) bool {
+	switch c.selector {
+	case selectParent:
+		for _, parent := range label.Parents {
+			if strings.EqualFold(aws.ToString(parent.Name), c.name) {
+				return true
+			}
+		}
+	case selectCategory:
+		for _, category := range label.Categories {
+			if strings.EqualFold(aws.ToString(category.Name), c.name) {
+				return true
+			}
+		}
+	default:
+		if strings.EqualFold(aws.ToString(label.Name), c.name) {
+			return true
+		}
+		for _, alias := range label.Aliases {
+			if strings.EqualFold(aws.ToString(alias.Name), c.name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *check) describe() string {
+	switch c.selector {
+	case selectParent:
+		return fmt.Sprintf("labels with parent %s", c.name)
+	case selectCategory:
+		return fmt.Sprintf("labels of category %s", c.name)
+	default:
+		return fmt.Sprintf("label %s", c.name)
+	}
+}
+
+func (c *check) String() string {
+	var conditions []string
+	if c.missingFails {
+		conditions = append(conditions, "present")
+	}
+	if c.absent {
+		conditions = append(conditions, "absent")
+	}
+	if c.min != nil {
+		conditions = append(conditions, fmt.Sprintf(">= %.2f", *c.min))
+	}
+	if c.max != nil {
+		conditions = append(conditions, fmt.Sprintf("<= %.2f", *c.max))
+	}
+	return fmt.Sprintf("%s %s", c.describe(), strings.Join(conditions, " "))
+}
+
+// ParseConfidences converts the legacy "Label:confidence[:missing],Label:confidence" format to label checks,
+// missing is the policy when the label is not returned at all, defaultMissing is used when it is not set
+func ParseConfidences(confidences string, isMin bool, defaultMissing string) ([]LabelRule, error) {
+	var labelRules []LabelRule
+	for _, entry := range strings.Split(confidences, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		s := strings.Split(entry, ":")
+		if len(s) < 2 || len(s) > 3 || strings.TrimSpace(s[0]) == "" {
+			return nil, fmt.Errorf("malformed label confidence %q, expected Label:confidence[:missing]", entry)
+		}
+		confidenceFloat64, err := strconv.ParseFloat(strings.TrimSpace(s[1]), 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed confidence in %q: %w", entry, err)
+		}
+		confidence := float32(confidenceFloat64)
+		labelRule := LabelRule{Label: strings.TrimSpace(s[0]), Missing: defaultMissing}
+		if len(s) == 3 {
+			labelRule.Missing = strings.TrimSpace(s[2])
+		}
+		if isMin {
+			labelRule.MinConfidence = &confidence
+		} else {
+			labelRule.MaxConfidence = &confidence
+		}
+		labelRules = append(labelRules, labelRule)
+	}
+	return labelRules, nil
+}
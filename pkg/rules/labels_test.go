@@ -0,0 +1,96 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+)
+
+func confidence(value float32) *float32 {
+	return &value
+}
+
+func label(name string, confidence float32, parent string) types.Label {
+	l := types.Label{Name: aws.String(name), Confidence: aws.Float32(confidence)}
+	if parent != "" {
+		l.Parents = []types.Parent{{Name: aws.String(parent)}}
+	}
+	return l
+}
+
+func TestCompileRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  LabelRule
+		error string
+	}{
+		{name: "group and check", rule: LabelRule{Label: "Person", Present: true, All: []LabelRule{{Label: "Face", Present: true}}}, error: "either a group (all/any) or a label check"},
+		{name: "all and any", rule: LabelRule{All: []LabelRule{{Label: "Face", Present: true}}, Any: []LabelRule{{Label: "Face", Present: true}}}, error: "either all or any"},
+		{name: "label and parent", rule: LabelRule{Label: "Person", Parent: "Person", Present: true}, error: "only one of label, parent and category"},
+		{name: "present and absent", rule: LabelRule{Label: "Screen", Present: true, Absent: true}, error: "cannot be both present and absent"},
+		{name: "absent with confidence", rule: LabelRule{Label: "Screen", Absent: true, MinConfidence: confidence(50)}, error: "cannot have confidence limits"},
+		{name: "unknown missing policy", rule: LabelRule{Label: "Person", Missing: "ignore", MinConfidence: confidence(50)}, error: "missing of label Person should be"},
+		{name: "check of nothing", rule: LabelRule{Label: "Person"}, error: "does not check anything"},
+		{name: "confidence out of range", rule: LabelRule{Label: "Person", MinConfidence: confidence(101)}, error: "should be between 0 and 100"},
+		{name: "min above max", rule: LabelRule{Label: "Person", MinConfidence: confidence(90), MaxConfidence: confidence(80)}, error: "greater than max-confidence"},
+		{name: "invalid nested rule", rule: LabelRule{Any: []LabelRule{{Label: "Face", Present: true}, {}}}, error: "label-rules.any[1]: empty rule"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(test.rule)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected error containing %q, got %v", test.error, err)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	person := LabelRule{Label: "Human", Present: true, MinConfidence: confidence(90)}
+	tests := []struct {
+		name     string
+		rule     LabelRule
+		labels   []types.Label
+		failures int
+		missing  []string
+	}{
+		{name: "empty rule", labels: []types.Label{label("Screen", 99, "")}},
+		{name: "label by alias", rule: person, labels: []types.Label{{Name: aws.String("Person"), Confidence: aws.Float32(95), Aliases: []types.LabelAlias{{Name: aws.String("human")}}}}},
+		{name: "low confidence", rule: person, labels: []types.Label{label("Human", 80, "")}, failures: 1},
+		{name: "missing label", rule: person, failures: 1, missing: []string{"Human"}},
+		{name: "missing label passes", rule: LabelRule{Label: "Human", MinConfidence: confidence(90)}},
+		{name: "absent parent", rule: LabelRule{Parent: "Electronics", Absent: true}, labels: []types.Label{label("Screen", 97, "Electronics")}, failures: 1},
+		{name: "any passes", rule: LabelRule{Any: []LabelRule{person, {Label: "Face", Present: true}}}, labels: []types.Label{label("Face", 99, "")}},
+		{name: "any fails once", rule: LabelRule{Any: []LabelRule{person, {Label: "Face", Present: true}}}, failures: 1, missing: []string{"Human", "Face"}},
+		{name: "all fails for every rule", rule: LabelRule{All: []LabelRule{person, {Label: "Face", Present: true}}}, failures: 2, missing: []string{"Human", "Face"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compiled, err := Compile(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := compiled.Evaluate(test.labels)
+			if len(result.Failures) != test.failures || strings.Join(result.MissingLabels, ",") != strings.Join(test.missing, ",") {
+				t.Fatalf("expected %d failures and missing labels %v, got %+v", test.failures, test.missing, result)
+			}
+		})
+	}
+}
+
+func TestParseConfidences(t *testing.T) {
+	parsed, err := ParseConfidences("Person:90, Face:80:pass,", true, MissingFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed[0].Label != "Person" || *parsed[0].MinConfidence != 90 || parsed[0].Missing != MissingFail || parsed[1].Missing != MissingPass {
+		t.Fatalf("unexpected rules %+v", parsed)
+	}
+	for _, malformed := range []string{"Person", "Person:high", ":90", "Person:90:pass:fail"} {
+		if _, err := ParseConfidences(malformed, true, MissingFail); err == nil {
+			t.Errorf("expected %q to be rejected", malformed)
+		}
+	}
+}
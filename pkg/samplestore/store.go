@@ -0,0 +1,320 @@
+package samplestore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrExists      = errors.New("already exists")
+	ErrInvalidName = errors.New("invalid name")
+)
+
+// Extensions are the image files considered as samples
+var Extensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".bmp": true, ".tif": true, ".tiff": true,
+}
+
+// validName allows letters, digits, spaces, dots, dashes and underscores, so that names are safe as file names
+var validName = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} ._-]{0,63}$`)
+
+// Store keeps samples in a directory: every person is a subdirectory with the person's samples,
+// an image right in the directory is a sample of the person named after the file
+type Store struct {
+	dir string
+}
+
+type Sample struct {
+	Person string `json:"person"`
+	Name   string `json:"name"`
+	Path   string `json:"-"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type Person struct {
+	Name    string   `json:"name"`
+	Samples []Sample `json:"samples"`
+}
+
+func New(dir string) *Store {
+	return &Store{dir: filepath.Clean(dir)}
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// PersonOf tells which person the sample file belongs to
+func (s *Store) PersonOf(path string) (string, bool) {
+	relative, err := filepath.Rel(s.dir, path)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		return "", false
+	}
+	if dir, _ := filepath.Split(relative); dir != "" {
+		return strings.Split(filepath.ToSlash(relative), "/")[0], true
+	}
+	return stem(relative), true
+}
+
+// Samples lists the samples of all the people
+func (s *Store) Samples() ([]Sample, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read samples directory: %w", err)
+	}
+	var samples []Sample
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if hidden(entry.Name()) {
+				continue
+			}
+			personSamples, err := s.personDirSamples(entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, personSamples...)
+			continue
+		}
+		if sample, ok := s.sample(stem(entry.Name()), s.dir, entry); ok {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+// People lists all the people with their samples, people without samples are listed too
+func (s *Store) People() ([]Person, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read samples directory: %w", err)
+	}
+	people := map[string]*Person{}
+	person := func(name string) *Person {
+		if people[name] == nil {
+			people[name] = &Person{Name: name, Samples: []Sample{}}
+		}
+		return people[name]
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !hidden(entry.Name()) {
+			person(entry.Name())
+		}
+	}
+	samples, err := s.Samples()
+	if err != nil {
+		return nil, err
+	}
+	for _, sample := range samples {
+		p := person(sample.Person)
+		p.Samples = append(p.Samples, sample)
+	}
+
+	result := make([]Person, 0, len(people))
+	for _, p := range people {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// CreatePerson creates an empty directory for the person's samples
+func (s *Store) CreatePerson(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if s.exists(name) {
+		return fmt.Errorf("person %s %w", name, ErrExists)
+	}
+	return os.Mkdir(filepath.Join(s.dir, name), 0o755)
+}
+
+// RenamePerson renames the person's directory and the samples right in the samples directory
+func (s *Store) RenamePerson(name string, newName string) error {
+	if err := validateName(newName); err != nil {
+		return err
+	}
+	if !s.exists(name) {
+		return fmt.Errorf("person %s %w", name, ErrNotFound)
+	}
+	if s.exists(newName) {
+		return fmt.Errorf("person %s %w", newName, ErrExists)
+	}
+	if err := s.moveLooseSamples(name); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(s.dir, name), filepath.Join(s.dir, newName))
+}
+
+// DeletePerson removes the person with all the samples
+func (s *Store) DeletePerson(name string) error {
+	if !s.exists(name) {
+		return fmt.Errorf("person %s %w", name, ErrNotFound)
+	}
+	for _, loose := range s.looseSamples(name) {
+		if err := os.Remove(loose); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(s.dir, name))
+}
+
+// AddSample stores the image as a new sample of the existing person, the file is written atomically,
+// so that the samples watcher never reads it partially
+func (s *Store) AddSample(person string, content []byte, extension string) (Sample, error) {
+	if !s.exists(person) {
+		return Sample{}, fmt.Errorf("person %s %w", person, ErrNotFound)
+	}
+	if !Extensions[extension] {
+		return Sample{}, fmt.Errorf("extension %s: %w", extension, ErrInvalidName)
+	}
+	if err := s.moveLooseSamples(person); err != nil {
+		return Sample{}, err
+	}
+	dir := filepath.Join(s.dir, person)
+	name := newSampleName(dir, extension)
+	temporary, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return Sample{}, err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		return Sample{}, err
+	}
+	if err := temporary.Close(); err != nil {
+		return Sample{}, err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Rename(temporary.Name(), path); err != nil {
+		return Sample{}, err
+	}
+	return Sample{Person: person, Name: name, Path: path, Bytes: int64(len(content))}, nil
+}
+
+// Sample finds the sample of the person
+func (s *Store) Sample(person string, name string) (Sample, error) {
+	if validateName(person) != nil || validateName(name) != nil {
+		return Sample{}, fmt.Errorf("sample %s/%s %w", person, name, ErrNotFound)
+	}
+	samples, err := s.Samples()
+	if err != nil {
+		return Sample{}, err
+	}
+	for _, sample := range samples {
+		if sample.Person == person && sample.Name == name {
+			return sample, nil
+		}
+	}
+	return Sample{}, fmt.Errorf("sample %s/%s %w", person, name, ErrNotFound)
+}
+
+// DeleteSample removes the sample of the person, the person is kept even without samples
+func (s *Store) DeleteSample(person string, name string) error {
+	sample, err := s.Sample(person, name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(sample.Path)
+}
+
+func (s *Store) personDirSamples(person string) ([]Sample, error) {
+	dir := filepath.Join(s.dir, person)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read samples of %s: %w", person, err)
+	}
+	var samples []Sample
+	for _, entry := range entries {
+		if sample, ok := s.sample(person, dir, entry); ok {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+func (s *Store) sample(person string, dir string, entry os.DirEntry) (Sample, bool) {
+	// hidden files are usually temporary files of editors, copy tools and uploads
+	if entry.IsDir() || hidden(entry.Name()) || !Extensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+		return Sample{}, false
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return Sample{}, false
+	}
+	return Sample{Person: person, Name: entry.Name(), Path: filepath.Join(dir, entry.Name()), Bytes: info.Size()}, true
+}
+
+// exists tells whether the person has a directory or samples right in the samples directory
+func (s *Store) exists(name string) bool {
+	if validateName(name) != nil {
+		return false
+	}
+	if info, err := os.Stat(filepath.Join(s.dir, name)); err == nil && info.IsDir() {
+		return true
+	}
+	return len(s.looseSamples(name)) > 0
+}
+
+func (s *Store) looseSamples(name string) []string {
+	var loose []string
+	for extension := range Extensions {
+		path := filepath.Join(s.dir, name+extension)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			loose = append(loose, path)
+		}
+	}
+	sort.Strings(loose)
+	return loose
+}
+
+// moveLooseSamples moves samples right in the samples directory into the person's directory
+func (s *Store) moveLooseSamples(name string) error {
+	loose := s.looseSamples(name)
+	if len(loose) == 0 {
+		return nil
+	}
+	dir := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, path := range loose {
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSampleName names the sample after the current time, a suffix is added when several samples are added at once
+func newSampleName(dir string, extension string) string {
+	base := time.Now().UTC().Format("20060102-150405.000000")
+	name := base + extension
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, name)); errors.Is(err, os.ErrNotExist) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, extension)
+	}
+}
+
+func validateName(name string) error {
+	if !validName.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("%w: %q, only letters, digits, spaces, dots, dashes and underscores are allowed", ErrInvalidName, name)
+	}
+	return nil
+}
+
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func stem(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
@@ -0,0 +1,135 @@
+package tlsreload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+// debounce waits for the certificate and the key to be both written before they are reloaded
+const debounce = 500 * time.Millisecond
+
+// Reloader serves the certificate and the client CAs as they are in the files,
+// so that renewed certificates are used without a restart
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCaFile string
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	clientCas   *x509.CertPool
+}
+
+// New loads the certificate and the key, clientCaFile is empty unless client certificates are verified
+func New(certFile string, keyFile string, clientCaFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCaFile: clientCaFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again, the previous certificate is kept when the files are invalid
+func (r *Reloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	var clientCas *x509.CertPool
+	if r.clientCaFile != "" {
+		content, err := os.ReadFile(r.clientCaFile)
+		if err != nil {
+			return fmt.Errorf("cannot load client CA: %w", err)
+		}
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(content) {
+			return fmt.Errorf("cannot load client CA: no PEM certificates in %s", r.clientCaFile)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.certificate = &certificate
+	r.clientCas = clientCas
+	return nil
+}
+
+// TLSConfig is the server configuration which always uses the most recently loaded files,
+// client certificates are required and verified when the client CA is configured
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+			}
+			if r.clientCas != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = r.clientCas
+			}
+			return config, nil
+		},
+	}
+}
+
+// Watch reloads the files when they change until the context is done. The directories are watched,
+// since certificates are usually replaced by renaming files or, in Kubernetes, by swapping symlinks
+func (r *Reloader) Watch(ctx context.Context) error {
+	log := logging.WithContext(ctx)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watched := map[string]bool{}
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCaFile} {
+		if file == "" || watched[filepath.Dir(file)] {
+			continue
+		}
+		watched[filepath.Dir(file)] = true
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			return fmt.Errorf("cannot watch TLS files in %s: %w", filepath.Dir(file), err)
+		}
+	}
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			reload = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("Error watching TLS files: %v", err)
+		case <-reload:
+			reload = nil
+			if err := r.Reload(); err != nil {
+				log.Errorf("Cannot reload TLS files, the previous certificate is used: %v", err)
+				continue
+			}
+			log.Info("Reloaded TLS certificate")
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package visitors
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+const (
+	stateFile = "visitors.json"
+	// MaxFaces limits the faces of a visitor indexed in the collection, more faces do not improve matching much
+	MaxFaces = 5
+	// maxImages limits the crops kept for enrollment, the most recent ones are kept
+	maxImages = 5
+)
+
+var validId = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Visitor is a cluster of unknown faces which Rekognition considers the same person
+type Visitor struct {
+	Id string `json:"id"`
+	// FaceIds are the faces of the visitor indexed in the collection
+	FaceIds []string    `json:"faceIds"`
+	Visits  []time.Time `json:"visits"`
+	// Images are the file names of the most recent crops of the visitor
+	Images []string `json:"images"`
+}
+
+func (v Visitor) FirstSeen() time.Time {
+	return v.Visits[0]
+}
+
+func (v Visitor) LastSeen() time.Time {
+	return v.Visits[len(v.Visits)-1]
+}
+
+// VisitsSince counts the visits after the time
+func (v Visitor) VisitsSince(since time.Time) int {
+	count := 0
+	for _, visit := range v.Visits {
+		if visit.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+func (v Visitor) clone() Visitor {
+	v.FaceIds = append([]string(nil), v.FaceIds...)
+	v.Visits = append([]time.Time(nil), v.Visits...)
+	v.Images = append([]string(nil), v.Images...)
+	return v
+}
+
+// Store keeps the visitors in a directory: the state is a JSON file, the crops of every visitor are in a subdirectory
+type Store struct {
+	dir      string
+	lock     sync.Mutex
+	visitors map[string]*Visitor
+}
+
+// Open loads the visitors stored in the directory, the directory is created when missing
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create visitors directory: %w", err)
+	}
+	s := &Store{dir: filepath.Clean(dir), visitors: map[string]*Visitor{}}
+	content, err := os.ReadFile(filepath.Join(s.dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var visitors []*Visitor
+	if err := json.Unmarshal(content, &visitors); err != nil {
+		return nil, fmt.Errorf("cannot read visitors: %w", err)
+	}
+	for _, visitor := range visitors {
+		s.visitors[visitor.Id] = visitor
+	}
+	return s, nil
+}
+
+// ByFaceId finds the visitor the indexed face belongs to
+func (s *Store) ByFaceId(faceId string) (Visitor, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, visitor := range s.visitors {
+		for _, id := range visitor.FaceIds {
+			if id == faceId {
+				return visitor.clone(), true
+			}
+		}
+	}
+	return Visitor{}, false
+}
+
+// Add starts a new visitor with the first visit
+func (s *Store) Add(faceId string, crop []byte, at time.Time) (Visitor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id, err := newId()
+	if err != nil {
+		return Visitor{}, err
+	}
+	visitor := &Visitor{Id: id, FaceIds: []string{}, Visits: []time.Time{}, Images: []string{}}
+	if err := os.MkdirAll(filepath.Join(s.dir, id), 0o755); err != nil {
+		return Visitor{}, err
+	}
+	s.visitors[id] = visitor
+	if err := s.recordVisit(visitor, faceId, crop, at); err != nil {
+		return Visitor{}, err
+	}
+	return visitor.clone(), nil
+}
+
+// RecordVisit adds the visit of the known visitor, faceId is empty when the face was not indexed
+func (s *Store) RecordVisit(id string, faceId string, crop []byte, at time.Time) (Visitor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	visitor, ok := s.visitors[id]
+	if !ok {
+		return Visitor{}, fmt.Errorf("visitor %s %w", id, ErrNotFound)
+	}
+	if err := s.recordVisit(visitor, faceId, crop, at); err != nil {
+		return Visitor{}, err
+	}
+	return visitor.clone(), nil
+}
+
+func (s *Store) recordVisit(visitor *Visitor, faceId string, crop []byte, at time.Time) error {
+	visitor.Visits = append(visitor.Visits, at.UTC())
+	if faceId != "" {
+		visitor.FaceIds = append(visitor.FaceIds, faceId)
+	}
+	image := at.UTC().Format("20060102-150405.000000000") + ".jpg"
+	if err := os.WriteFile(filepath.Join(s.dir, visitor.Id, image), crop, 0o644); err != nil {
+		return err
+	}
+	visitor.Images = append(visitor.Images, image)
+	for len(visitor.Images) > maxImages {
+		if err := os.Remove(filepath.Join(s.dir, visitor.Id, visitor.Images[0])); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		visitor.Images = visitor.Images[1:]
+	}
+	return s.save()
+}
+
+// List returns the visitors, the most recently seen first
+func (s *Store) List() []Visitor {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	visitors := make([]Visitor, 0, len(s.visitors))
+	for _, visitor := range s.visitors {
+		visitors = append(visitors, visitor.clone())
+	}
+	sort.Slice(visitors, func(i, j int) bool { return visitors[i].LastSeen().After(visitors[j].LastSeen()) })
+	return visitors
+}
+
+func (s *Store) Get(id string) (Visitor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	visitor, ok := s.visitors[id]
+	if !ok {
+		return Visitor{}, fmt.Errorf("visitor %s %w", id, ErrNotFound)
+	}
+	return visitor.clone(), nil
+}
+
+// ImagePath is the path of the crop of the visitor
+func (s *Store) ImagePath(id string, image string) (string, error) {
+	visitor, err := s.Get(id)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range visitor.Images {
+		if name == image {
+			return filepath.Join(s.dir, id, image), nil
+		}
+	}
+	return "", fmt.Errorf("image %s of visitor %s %w", image, id, ErrNotFound)
+}
+
+// Remove forgets the visitor with the crops, the removed visitor is returned, so that its faces can be deleted
+func (s *Store) Remove(id string) (Visitor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	visitor, ok := s.visitors[id]
+	if !ok || !validId.MatchString(id) {
+		return Visitor{}, fmt.Errorf("visitor %s %w", id, ErrNotFound)
+	}
+	delete(s.visitors, id)
+	if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+		return Visitor{}, err
+	}
+	return *visitor, s.save()
+}
+
+// Expire drops the visits before the time and forgets the visitors without visits, which are returned
+func (s *Store) Expire(before time.Time) ([]Visitor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var expired []Visitor
+	changed := false
+	for id, visitor := range s.visitors {
+		recent := visitor.Visits[:0]
+		for _, visit := range visitor.Visits {
+			if !visit.Before(before) {
+				recent = append(recent, visit)
+			}
+		}
+		if len(recent) == len(visitor.Visits) {
+			continue
+		}
+		changed = true
+		visitor.Visits = recent
+		if len(recent) > 0 {
+			continue
+		}
+		delete(s.visitors, id)
+		if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+			return expired, err
+		}
+		expired = append(expired, *visitor)
+	}
+	if !changed {
+		return nil, nil
+	}
+	return expired, s.save()
+}
+
+// save writes the state atomically, so that it is never read partially
+func (s *Store) save() error {
+	visitors := make([]*Visitor, 0, len(s.visitors))
+	for _, visitor := range s.visitors {
+		visitors = append(visitors, visitor)
+	}
+	sort.Slice(visitors, func(i, j int) bool { return visitors[i].Id < visitors[j].Id })
+	content, err := json.MarshalIndent(visitors, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := filepath.Join(s.dir, "."+stateFile)
+	if err := os.WriteFile(temporary, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, filepath.Join(s.dir, stateFile))
+}
+
+func newId() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
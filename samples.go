@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/adutchak/recognizer/pkg/config"
+	"github.com/adutchak/recognizer/pkg/imaging"
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/samplestore"
+)
+
+// sampleReport is the result of validating a single sample
+type sampleReport struct {
+	Sample     string   `json:"sample"`
+	Bytes      int      `json:"bytes"`
+	Faces      int      `json:"faces"`
+	Brightness float32  `json:"brightness,omitempty"`
+	Sharpness  float32  `json:"sharpness,omitempty"`
+	Problems   []string `json:"problems,omitempty"`
+	// Warnings do not make the sample invalid, e.g. a large sample which is downscaled on load
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (s *sampleReport) valid() bool {
+	return len(s.Problems) == 0
+}
+
+func (s *sampleReport) addProblem(format string, args ...interface{}) {
+	s.Problems = append(s.Problems, fmt.Sprintf(format, args...))
+}
+
+func (s *sampleReport) addWarning(format string, args ...interface{}) {
+	s.Warnings = append(s.Warnings, fmt.Sprintf(format, args...))
+}
+
+type sampleDigest [sha256.Size]byte
+
+// getRekognitionInputs loads all the samples, samples which cannot be loaded are skipped unless validation is strict
+func getRekognitionInputs(ctx context.Context, configuration *config.Config) ([]map[string]rekognition.CompareFacesInput, map[string]sampleDigest, error) {
+	log := logging.WithContext(ctx)
+	var rekognitionInputs []map[string]rekognition.CompareFacesInput
+	digests := map[string]sampleDigest{}
+	samples, err := samplePaths(configuration)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, sample := range samples {
+		compareFacesInput, digest, err := loadSample(configuration, sample)
+		if err != nil && configuration.ValidateSamplesStrict {
+			log.Errorf("Error reading sample %s: %v", sample, err)
+			return rekognitionInputs, digests, err
+		}
+		if err != nil {
+			log.Warnf("Skipping sample %s: %v", sample, err)
+			continue
+		}
+		element := map[string]rekognition.CompareFacesInput{
+			sample: compareFacesInput,
+		}
+		rekognitionInputs = append(rekognitionInputs, element)
+		digests[sample] = digest
+	}
+	return rekognitionInputs, digests, nil
+}
+
+// loadSample reads the sample, samples are compared as they are, so they should be acceptable by Rekognition
+func loadSample(configuration *config.Config, sample string) (rekognition.CompareFacesInput, sampleDigest, error) {
+	targeBytes, err := os.ReadFile(sample)
+	if err != nil {
+		return rekognition.CompareFacesInput{}, sampleDigest{}, err
+	}
+	digest := sha256.Sum256(targeBytes)
+	targeBytes, err = imaging.Normalize(targeBytes, imaging.MaxImageBytes)
+	if err != nil {
+		return rekognition.CompareFacesInput{}, sampleDigest{}, err
+	}
+
+	targetImage := types.Image{
+		Bytes: targeBytes,
+	}
+	compareFacesInput := rekognition.CompareFacesInput{
+		TargetImage:         &targetImage,
+		SimilarityThreshold: &configuration.SimilarityThreshold,
+		QualityFilter:       "AUTO",
+	}
+	return compareFacesInput, digest, nil
+}
+
+// samplePaths lists the samples specified explicitly and the samples of all the people in the samples directory
+func samplePaths(configuration *config.Config) ([]string, error) {
+	samples := append([]string(nil), configuration.SampleImagePaths...)
+	if configuration.SampleImagesDir == "" {
+		return samples, nil
+	}
+	stored, err := samplestore.New(configuration.SampleImagesDir).Samples()
+	if err != nil {
+		return nil, err
+	}
+	for _, sample := range stored {
+		samples = append(samples, sample.Path)
+	}
+	return samples, nil
+}
+
+// personOf names the person of the sample: the directory of the person in the samples directory,
+// or the file name without the extension
+func (r *recognizer) personOf(sample string) string {
+	if r.sampleStore != nil {
+		if person, ok := r.sampleStore.PersonOf(sample); ok {
+			return person
+		}
+	}
+	return strings.TrimSuffix(filepath.Base(sample), filepath.Ext(sample))
+}
+
+// inputs returns the current samples, the slice is never modified, it is replaced when samples are reloaded
+func (r *recognizer) inputs() []map[string]rekognition.CompareFacesInput {
+	r.samplesLock.RLock()
+	defer r.samplesLock.RUnlock()
+	return r.rekognitionInputs
+}
+
+func (r *recognizer) setInputs(rekognitionInputs []map[string]rekognition.CompareFacesInput, digests map[string]sampleDigest) {
+	r.samplesLock.Lock()
+	defer r.samplesLock.Unlock()
+	r.rekognitionInputs = rekognitionInputs
+	r.sampleDigests = digests
+}
+
+// samplesDiff lists the samples changed by a reload
+type samplesDiff struct {
+	Added   []string
+	Changed []string
+	Removed []string
+}
+
+func (d samplesDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// reloadSamples reads the samples again and swaps them when something has changed, unchanged samples are reused.
+// Samples which cannot be loaded are skipped, a changed sample keeps its previous version in that case
+func (r *recognizer) reloadSamples(ctx context.Context) (samplesDiff, error) {
+	log := logging.WithContext(ctx)
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+	var diff samplesDiff
+	samples, err := samplePaths(r.configuration)
+	if err != nil {
+		return diff, err
+	}
+
+	r.samplesLock.RLock()
+	previousDigests := r.sampleDigests
+	previousInputs := map[string]rekognition.CompareFacesInput{}
+	for _, rekognitionInput := range r.rekognitionInputs {
+		for sample, input := range rekognitionInput {
+			previousInputs[sample] = input
+		}
+	}
+	r.samplesLock.RUnlock()
+
+	var rekognitionInputs []map[string]rekognition.CompareFacesInput
+	digests := map[string]sampleDigest{}
+	for _, sample := range samples {
+		content, err := os.ReadFile(sample)
+		if err != nil {
+			log.Warnf("Cannot read sample %s: %v", sample, err)
+			continue
+		}
+		digest := sha256.Sum256(content)
+		previousDigest, existed := previousDigests[sample]
+
+		input, loaded := previousInputs[sample]
+		if !existed || digest != previousDigest {
+			input, loaded = r.loadChangedSample(ctx, sample)
+			switch {
+			case loaded && existed:
+				diff.Changed = append(diff.Changed, sample)
+			case loaded:
+				diff.Added = append(diff.Added, sample)
+			case existed:
+				// keep the previous version of the sample
+				input, loaded, digest = previousInputs[sample], true, previousDigest
+			}
+		}
+		if !loaded {
+			continue
+		}
+		rekognitionInputs = append(rekognitionInputs, map[string]rekognition.CompareFacesInput{sample: input})
+		digests[sample] = digest
+	}
+	for sample := range previousDigests {
+		if _, ok := digests[sample]; !ok {
+			diff.Removed = append(diff.Removed, sample)
+		}
+	}
+	sort.Strings(diff.Removed)
+
+	if diff.empty() {
+		return diff, nil
+	}
+	r.setInputs(rekognitionInputs, digests)
+	log.Infof("Reloaded %d samples, added: %v, changed: %v, removed: %v", len(rekognitionInputs), diff.Added, diff.Changed, diff.Removed)
+	return diff, nil
+}
+
+// loadChangedSample validates and loads a new or changed sample, in strict mode invalid samples are not loaded
+func (r *recognizer) loadChangedSample(ctx context.Context, sample string) (rekognition.CompareFacesInput, bool) {
+	log := logging.WithContext(ctx)
+	if r.configuration.ValidateSamples {
+		report := r.validateSample(ctx, sample)
+		if !report.valid() {
+			log.Warnf("Sample %s: %s", sample, strings.Join(report.Problems, "; "))
+			if r.configuration.ValidateSamplesStrict {
+				return rekognition.CompareFacesInput{}, false
+			}
+		}
+	}
+	input, _, err := loadSample(r.configuration, sample)
+	if err != nil {
+		log.Warnf("Cannot load sample %s: %v", sample, err)
+		return rekognition.CompareFacesInput{}, false
+	}
+	return input, true
+}
+
+// watchSamples reloads samples whenever files change in the directories of the samples,
+// events are debounced, since files are usually written in several steps
+func (r *recognizer) watchSamples(ctx context.Context) error {
+	log := logging.WithContext(ctx)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range sampleDirs(r.configuration) {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("cannot watch samples directory %s: %w", dir, err)
+		}
+		log.Infof("Watching samples in %s", dir)
+	}
+
+	debounce := time.Millisecond * time.Duration(r.configuration.WatchSamplesDebounceMilliseconds)
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			// directories of new people have to be watched too
+			if event.Has(fsnotify.Create) && r.isPersonDir(event.Name) {
+				if err := watcher.Add(event.Name); err != nil {
+					log.Errorf("Cannot watch samples directory %s: %v", event.Name, err)
+				}
+			}
+			reload = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("Error watching samples: %v", err)
+		case <-reload:
+			reload = nil
+			if _, err := r.reloadSamples(ctx); err != nil {
+				log.Errorf("Cannot reload samples: %v", err)
+			}
+		}
+	}
+}
+
+// isPersonDir tells whether the path is a directory of a person right in the samples directory
+func (r *recognizer) isPersonDir(path string) bool {
+	if r.sampleStore == nil || filepath.Dir(path) != r.sampleStore.Dir() {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// sampleDirs are the directories of all the samples specified explicitly, the samples directory
+// and the directories of the people in it
+func sampleDirs(configuration *config.Config) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, sample := range configuration.SampleImagePaths {
+		add(filepath.Dir(sample))
+	}
+	if configuration.SampleImagesDir != "" {
+		dir := filepath.Clean(configuration.SampleImagesDir)
+		add(dir)
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				add(filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return dirs
+}
+
+// checkSamples validates all the samples and logs the report,
+// an error is returned only in strict mode when some of the samples are invalid
+func (r *recognizer) checkSamples(ctx context.Context) ([]sampleReport, error) {
+	log := logging.WithContext(ctx)
+	samples, err := samplePaths(r.configuration)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]sampleReport, 0, len(samples))
+	invalid := 0
+	for _, sample := range samples {
+		report := r.validateSample(ctx, sample)
+		if report.valid() {
+			log.Infof("Sample %s: OK, brightness %.1f, sharpness %.1f", sample, report.Brightness, report.Sharpness)
+			for _, warning := range report.Warnings {
+				log.Warnf("Sample %s: %s", sample, warning)
+			}
+		} else {
+			invalid++
+			log.Warnf("Sample %s: %s", sample, strings.Join(report.Problems, "; "))
+		}
+		reports = append(reports, report)
+	}
+	log.Infof("Validated %d samples, %d with problems", len(reports), invalid)
+	if invalid > 0 && r.configuration.ValidateSamplesStrict {
+		return reports, fmt.Errorf("%d of %d samples are invalid", invalid, len(reports))
+	}
+	return reports, nil
+}
+
+// validateSample makes sure that the sample can be decoded, is not too large and has exactly one good quality face
+func (r *recognizer) validateSample(ctx context.Context, sample string) sampleReport {
+	content, err := os.ReadFile(sample)
+	if err != nil {
+		report := sampleReport{Sample: sample}
+		report.addProblem("cannot read the file: %v", err)
+		return report
+	}
+	return r.validateSampleBytes(ctx, sample, content)
+}
+
+// validateSampleBytes validates the content of the sample, which is not necessarily stored yet
+func (r *recognizer) validateSampleBytes(ctx context.Context, sample string, content []byte) sampleReport {
+	report := sampleReport{Sample: sample}
+	report.Bytes = len(content)
+	normalized, err := imaging.Normalize(content, imaging.MaxImageBytes)
+	if err != nil {
+		report.addProblem("%v", err)
+		return report
+	}
+	if len(content) > imaging.MaxImageBytes {
+		report.addWarning("larger than %d bytes, it is downscaled on load", imaging.MaxImageBytes)
+	}
+
+	input := rekognition.DetectFacesInput{
+		Image: &types.Image{Bytes: normalized},
+	}
+	var output *rekognition.DetectFacesOutput
+	err = r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		output, err = r.recognizeClient.DetectFaces(ctx, &input)
+		return err
+	})
+	var invalidFormat *types.InvalidImageFormatException
+	if errors.As(err, &invalidFormat) {
+		report.addProblem("cannot be decoded by Rekognition")
+		return report
+	}
+	if err != nil {
+		report.addProblem("cannot detect faces: %v", err)
+		return report
+	}
+
+	report.Faces = len(output.FaceDetails)
+	if report.Faces != 1 {
+		report.addProblem("%d faces detected, expected exactly one", report.Faces)
+		return report
+	}
+	quality := output.FaceDetails[0].Quality
+	if quality == nil {
+		return report
+	}
+	report.Brightness = aws.ToFloat32(quality.Brightness)
+	report.Sharpness = aws.ToFloat32(quality.Sharpness)
+	if report.Brightness < r.configuration.SampleMinBrightness {
+		report.addProblem("brightness %.1f is less than %.1f", report.Brightness, r.configuration.SampleMinBrightness)
+	}
+	if report.Sharpness < r.configuration.SampleMinSharpness {
+		report.addProblem("sharpness %.1f is less than %.1f", report.Sharpness, r.configuration.SampleMinSharpness)
+	}
+	return report
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+)
+
+const (
+	// streamBuffer is the number of results kept for a slow stream client before they are dropped
+	streamBuffer = 16
+	// streamKeepAliveInterval keeps idle connections open through proxies
+	streamKeepAliveInterval = 30 * time.Second
+)
+
+// streamedResult is the result of a recognition sent to the stream along with the MQTT message
+type streamedResult struct {
+	Time time.Time `json:"time"`
+	recognitionResult
+}
+
+// streamResult sends the result to the connected stream clients, the result is encoded right away,
+// since the recognition may still change it
+func (r *recognizer) streamResult(result recognitionResult) {
+	if r.resultsStream.Subscribers() == 0 {
+		return
+	}
+	message, err := json.Marshal(streamedResult{Time: time.Now().UTC(), recognitionResult: result})
+	if err != nil {
+		logging.WithContext(context.Background()).Errorf("Cannot encode the result for the stream: %v", err)
+		return
+	}
+	r.resultsStream.Publish(message)
+}
+
+// StreamEventsApiHandler pushes recognition results as Server-Sent Events as they are published over MQTT
+func (r *recognizer) StreamEventsApiHandler(writer http.ResponseWriter, request *http.Request) {
+	log := logging.WithContext(context.Background())
+	controller := http.NewResponseController(writer)
+	// the stream is open as long as the client listens, unlike the responses the write timeout is for
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		log.Warnf("Cannot disable the write timeout of the stream: %v", err)
+	}
+	results, unsubscribe := r.resultsStream.Subscribe()
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	// the comment lets the client know it is connected before the first result
+	fmt.Fprint(writer, ": connected\n\n")
+	if err := controller.Flush(); err != nil {
+		log.Errorf("Cannot stream results: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(writer, ": keep-alive\n\n")
+		case result := <-results:
+			fmt.Fprintf(writer, "event: recognition\ndata: %s\n\n", result)
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
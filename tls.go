@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/tlsreload"
+)
+
+// newApiServer configures the API server, with TLS when the certificate is configured,
+// the certificate is reloaded when its files change until the context is done
+func (r *recognizer) newApiServer(ctx context.Context) (*http.Server, error) {
+	log := logging.WithContext(ctx)
+	server := &http.Server{
+		Addr:         r.configuration.ApiListenAddress,
+		Handler:      r.newRouter(),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  10 * time.Second,
+	}
+	if r.configuration.ApiTlsCertFile == "" {
+		return server, nil
+	}
+
+	reloader, err := tlsreload.New(r.configuration.ApiTlsCertFile, r.configuration.ApiTlsKeyFile, r.configuration.ApiTlsClientCaFile)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := reloader.Watch(ctx); err != nil {
+			log.Errorf("Cannot watch TLS files, changes are not reloaded: %v", err)
+		}
+	}()
+	server.TLSConfig = reloader.TLSConfig()
+	if r.configuration.ApiTlsClientCaFile != "" {
+		log.Info("API clients have to present a certificate signed by the client CA")
+	}
+	return server, nil
+}
+
+// runHttpsRedirect serves plain HTTP only to redirect to the HTTPS API, the API itself is never served without TLS
+func (r *recognizer) runHttpsRedirect() {
+	log := logging.WithContext(context.Background())
+	server := &http.Server{
+		Addr:         r.configuration.ApiHttpRedirectAddress,
+		Handler:      httpsRedirectHandler(r.configuration.ApiListenAddress),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  10 * time.Second,
+	}
+	log.Infof("Redirecting HTTP requests on %s to HTTPS", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Error starting HTTP redirect server: %v", err)
+	}
+}
+
+// httpsRedirectHandler redirects pages to the same URL on the port of the HTTPS API. Other requests are rejected,
+// since their keys and bodies were already sent in cleartext, and following a redirect would hide that from the client
+func httpsRedirectHandler(listenAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(listenAddress)
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			respondWithError(writer, http.StatusBadRequest, "the API is served only over HTTPS, use the https scheme")
+			return
+		}
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		host = strings.Trim(host, "[]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: request.URL.Path, RawQuery: request.URL.RawQuery}
+		http.Redirect(writer, request, target.String(), http.StatusMovedPermanently)
+	})
+}
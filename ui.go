@@ -0,0 +1,25 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the web UI, it uses the API, so it is served along with it
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func uiHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+}
+
+// GetConfigApiHandler shows the current configuration without secrets
+func (r *recognizer) GetConfigApiHandler(writer http.ResponseWriter, request *http.Request) {
+	respondWithJSON(writer, http.StatusOK, r.configuration.Redacted())
+}
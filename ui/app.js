@@ -0,0 +1,226 @@
+"use strict";
+
+// element creates an element with the text, text is never parsed as HTML since names come from users
+function element(tag, text, className) {
+  const created = document.createElement(tag);
+  if (text !== undefined) {
+    created.textContent = text;
+  }
+  if (className) {
+    created.className = className;
+  }
+  return created;
+}
+
+// authorizedFetch presents the API key, which is kept in the browser only
+function authorizedFetch(url, options = {}) {
+  const key = localStorage.getItem("apiKey");
+  const headers = new Headers(options.headers);
+  if (key) {
+    headers.set("Authorization", "Bearer " + key);
+  }
+  return fetch(url, { ...options, headers });
+}
+
+// thumbnail loads the image with the API key, since images do not send headers
+function thumbnail(url, title) {
+  const link = element("a");
+  link.target = "_blank";
+  const image = element("img", undefined, "thumbnail");
+  image.alt = title;
+  link.append(image);
+  authorizedFetch(url)
+    .then((response) => (response.ok ? response.blob() : Promise.reject(new Error(response.statusText))))
+    .then((blob) => {
+      link.href = image.src = URL.createObjectURL(blob);
+    })
+    .catch(() => {
+      image.alt = title + " is not available";
+    });
+  return link;
+}
+
+async function getJSON(url) {
+  const response = await authorizedFetch(url);
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.message || response.statusText);
+  }
+  return body;
+}
+
+// showNotice shows the message in the section, e.g. when the feature is not configured, an empty message hides it
+function showNotice(section, message) {
+  const notice = section.querySelector(".notice");
+  notice.textContent = message;
+  notice.hidden = !message;
+}
+
+async function loadEvents() {
+  const section = document.getElementById("events");
+  const rows = section.querySelector("tbody");
+  try {
+    const body = await getJSON("/v1/events?limit=50");
+    showNotice(section, body.events.length ? "" : "No events yet");
+    rows.replaceChildren(...body.events.map(eventRow));
+  } catch (error) {
+    showNotice(section, error.message);
+    rows.replaceChildren();
+  }
+}
+
+function eventRow(event) {
+  const row = element("tr");
+  const snapshot = element("td");
+  if (event.imageUrl) {
+    snapshot.append(thumbnail(event.imageUrl, "snapshot of event " + event.id));
+  }
+  row.append(
+    snapshot,
+    element("td", new Date(event.time).toLocaleString()),
+    element("td", event.camera),
+    element("td", event.decision, event.decision),
+    element("td", event.person ? event.person + " (" + event.similarity.toFixed(1) + ")" : ""),
+    element("td", event.failingRules.join("; ") || event.message || ""),
+    element("td", event.latencyMilliseconds + " ms"),
+  );
+  return row;
+}
+
+async function loadPeople() {
+  const section = document.getElementById("people");
+  const people = section.querySelector(".people");
+  try {
+    const body = await getJSON("/v1/people");
+    showNotice(section, body.people.length ? "" : "No people enrolled yet");
+    people.replaceChildren(...body.people.map(personCard));
+  } catch (error) {
+    showNotice(section, error.message);
+    people.replaceChildren();
+  }
+}
+
+function personCard(person) {
+  const card = element("div", undefined, "person");
+  const title = person.name + " (" + person.samples.length + " samples" + (person.managed ? "" : ", configured") + ")";
+  card.append(element("h3", title));
+  for (const sample of person.samples) {
+    if (person.managed) {
+      const url = "/v1/people/" + encodeURIComponent(person.name) + "/samples/" + encodeURIComponent(sample.name);
+      card.append(thumbnail(url, sample.name));
+    } else {
+      card.append(element("div", sample.name));
+    }
+  }
+  return card;
+}
+
+async function loadConfig() {
+  const pre = document.querySelector("#config pre");
+  try {
+    const config = await getJSON("/v1/config");
+    pre.textContent = JSON.stringify(config, null, 2);
+    document.getElementById("status").textContent =
+      config.runMode + " mode" + (config.discoveryMode ? ", discovery" : "") + (config.livenessEnabled ? ", liveness" : "");
+  } catch (error) {
+    pre.textContent = error.message;
+  }
+}
+
+// withoutCredentials removes the user and the password from the stream URL, so that they are not kept in the browser,
+// a URL which cannot be parsed is not kept at all
+function withoutCredentials(value) {
+  try {
+    const url = new URL(value);
+    url.username = "";
+    url.password = "";
+    return url.toString();
+  } catch {
+    return "";
+  }
+}
+
+async function testRecognition(submitted) {
+  submitted.preventDefault();
+  const form = submitted.target;
+  const button = form.querySelector("button");
+  const result = document.getElementById("recognize-result");
+  const input = Object.fromEntries(new FormData(form));
+  localStorage.setItem("recognize", JSON.stringify({ ...input, webrtc_url: withoutCredentials(input.webrtc_url) }));
+
+  button.disabled = true;
+  result.hidden = false;
+  result.textContent = "Recognizing…";
+  try {
+    const response = await authorizedFetch("/v1/recognize", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(input),
+    });
+    result.textContent = response.status + " " + JSON.stringify(await response.json(), null, 2);
+  } catch (error) {
+    result.textContent = error.message;
+  } finally {
+    button.disabled = false;
+  }
+  loadEvents();
+}
+
+function restoreRecognizeForm() {
+  const form = document.getElementById("recognize");
+  const saved = JSON.parse(localStorage.getItem("recognize") || "{}");
+  for (const [name, value] of Object.entries(saved)) {
+    if (form.elements[name]) {
+      form.elements[name].value = value;
+    }
+  }
+  form.addEventListener("submit", testRecognition);
+}
+
+// followStream reloads events when results are published, the stream is read with fetch,
+// since EventSource cannot present the API key
+async function followStream() {
+  try {
+    const response = await authorizedFetch("/v1/events/stream");
+    if (response.ok) {
+      const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) {
+          break;
+        }
+        if (value.includes("event: recognition")) {
+          // events are recorded right after the result is published, so they are loaded a moment later
+          setTimeout(loadEvents, 1000);
+        }
+      }
+    }
+  } catch (error) {
+    console.warn("events stream is interrupted", error);
+  }
+  setTimeout(followStream, 5000);
+}
+
+function loadAll() {
+  loadConfig();
+  loadPeople();
+  loadEvents();
+}
+
+function restoreApiKeyForm() {
+  const form = document.getElementById("api-key");
+  form.elements.key.value = localStorage.getItem("apiKey") || "";
+  form.addEventListener("submit", (submitted) => {
+    submitted.preventDefault();
+    localStorage.setItem("apiKey", form.elements.key.value);
+    loadAll();
+  });
+}
+
+restoreApiKeyForm();
+restoreRecognizeForm();
+document.getElementById("refresh-events").addEventListener("click", loadEvents);
+loadAll();
+followStream();
+// discovery mode records events without publishing them
+setInterval(loadEvents, 30000);
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition"
+	"github.com/aws/aws-sdk-go-v2/service/rekognition/types"
+	"github.com/gorilla/mux"
+
+	"github.com/adutchak/recognizer/pkg/logging"
+	"github.com/adutchak/recognizer/pkg/samplestore"
+	"github.com/adutchak/recognizer/pkg/visitors"
+)
+
+// errFaceNotIndexed is returned when Rekognition does not index the face of a new visitor, e.g. because of its low quality,
+// such a visitor could never be found again
+var errFaceNotIndexed = errors.New("the face is not indexed by Rekognition")
+
+type visitorResponse struct {
+	Id        string    `json:"id"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Visits    int       `json:"visits"`
+	// RecentVisits are counted within the frequent visitor window
+	RecentVisits int      `json:"recentVisits"`
+	Frequent     bool     `json:"frequent"`
+	Faces        int      `json:"faces"`
+	Images       []string `json:"images"`
+}
+
+type visitorsResponse struct {
+	Visitors []visitorResponse `json:"visitors"`
+}
+
+type enrollVisitorResponse struct {
+	Samples []sampleResponse `json:"samples"`
+	Reports []sampleReport   `json:"reports,omitempty"`
+}
+
+// ensureVisitorsCollection creates the collection for faces of unknown visitors unless it exists
+func (r *recognizer) ensureVisitorsCollection(ctx context.Context) error {
+	input := rekognition.CreateCollectionInput{CollectionId: &r.configuration.VisitorsCollectionId}
+	err := r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		_, err = r.recognizeClient.CreateCollection(ctx, &input)
+		return err
+	})
+	var exists *types.ResourceAlreadyExistsException
+	if errors.As(err, &exists) {
+		return nil
+	}
+	return err
+}
+
+// trackVisitors assigns the unknown faces to visitors, faces which Rekognition considers the same person
+// are clustered into one visitor, so that repeated visits of the same stranger are noticed
+func (r *recognizer) trackVisitors(ctx context.Context, faces []*faceComparison, results []faceResult) {
+	log := logging.WithContext(ctx)
+	if r.visitors == nil {
+		return
+	}
+	// faces of the same visitor on concurrent snapshots should not start several visitors
+	r.visitorsLock.Lock()
+	defer r.visitorsLock.Unlock()
+
+	now := time.Now()
+	r.expireVisitors(ctx, now)
+	for i, face := range faces {
+		if results[i].Status != faceStatusUnknown {
+			continue
+		}
+		visitor, err := r.trackVisitor(ctx, face.image.Bytes, now)
+		if errors.Is(err, errFaceNotIndexed) {
+			log.Warnf("Face %d is not tracked as a visitor: %v", results[i].Index, err)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Cannot track face %d as a visitor: %v", results[i].Index, err)
+			continue
+		}
+		results[i].Visitor = visitor.Id
+		recent := visitor.VisitsSince(now.Add(-r.frequentWindow()))
+		if recent >= r.configuration.VisitorsFrequentVisits {
+			log.Warnf("Face %d: frequent visitor %s, %d visits in the last %d days", results[i].Index, visitor.Id, recent, r.configuration.VisitorsFrequentDays)
+		} else {
+			log.Infof("Face %d: visitor %s, %d visits in the last %d days", results[i].Index, visitor.Id, recent, r.configuration.VisitorsFrequentDays)
+		}
+	}
+}
+
+// trackVisitor searches the face in the collection and records the visit of the matching visitor,
+// a new visitor is started when there is no match and the face can be indexed
+func (r *recognizer) trackVisitor(ctx context.Context, crop []byte, now time.Time) (visitors.Visitor, error) {
+	searchInput := rekognition.SearchFacesByImageInput{
+		CollectionId:       &r.configuration.VisitorsCollectionId,
+		Image:              &types.Image{Bytes: crop},
+		FaceMatchThreshold: &r.configuration.VisitorsMatchThreshold,
+		MaxFaces:           aws.Int32(1),
+	}
+	var searchOutput *rekognition.SearchFacesByImageOutput
+	err := r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		searchOutput, err = r.recognizeClient.SearchFacesByImage(ctx, &searchInput)
+		return err
+	})
+	if err != nil {
+		return visitors.Visitor{}, err
+	}
+
+	for _, match := range searchOutput.FaceMatches {
+		if match.Face == nil {
+			continue
+		}
+		visitor, ok := r.visitors.ByFaceId(aws.ToString(match.Face.FaceId))
+		if !ok {
+			continue
+		}
+		faceId := ""
+		if len(visitor.FaceIds) < visitors.MaxFaces {
+			if faceId, err = r.indexVisitorFace(ctx, crop); err != nil {
+				return visitors.Visitor{}, err
+			}
+		}
+		return r.visitors.RecordVisit(visitor.Id, faceId, crop, now)
+	}
+
+	faceId, err := r.indexVisitorFace(ctx, crop)
+	if err != nil {
+		return visitors.Visitor{}, err
+	}
+	if faceId == "" {
+		return visitors.Visitor{}, errFaceNotIndexed
+	}
+	return r.visitors.Add(faceId, crop, now)
+}
+
+// indexVisitorFace adds the face to the collection, the id is empty when Rekognition did not index the face
+func (r *recognizer) indexVisitorFace(ctx context.Context, crop []byte) (string, error) {
+	input := rekognition.IndexFacesInput{
+		CollectionId:  &r.configuration.VisitorsCollectionId,
+		Image:         &types.Image{Bytes: crop},
+		MaxFaces:      aws.Int32(1),
+		QualityFilter: types.QualityFilterAuto,
+	}
+	var output *rekognition.IndexFacesOutput
+	err := r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		output, err = r.recognizeClient.IndexFaces(ctx, &input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(output.FaceRecords) == 0 || output.FaceRecords[0].Face == nil {
+		return "", nil
+	}
+	return aws.ToString(output.FaceRecords[0].Face.FaceId), nil
+}
+
+// expireVisitors forgets the visits older than the retention along with the faces of visitors without visits
+func (r *recognizer) expireVisitors(ctx context.Context, now time.Time) {
+	log := logging.WithContext(ctx)
+	expired, err := r.visitors.Expire(now.AddDate(0, 0, -r.configuration.VisitorsRetentionDays))
+	if err != nil {
+		log.Errorf("Cannot expire visitors: %v", err)
+	}
+	for _, visitor := range expired {
+		log.Infof("Forgot visitor %s, last seen %s", visitor.Id, visitor.LastSeen())
+		r.deleteVisitorFaces(ctx, visitor)
+	}
+}
+
+func (r *recognizer) deleteVisitorFaces(ctx context.Context, visitor visitors.Visitor) {
+	if len(visitor.FaceIds) == 0 {
+		return
+	}
+	input := rekognition.DeleteFacesInput{
+		CollectionId: &r.configuration.VisitorsCollectionId,
+		FaceIds:      visitor.FaceIds,
+	}
+	err := r.callRekognition(ctx, func(ctx context.Context) (err error) {
+		_, err = r.recognizeClient.DeleteFaces(ctx, &input)
+		return err
+	})
+	if err != nil {
+		logging.WithContext(ctx).Errorf("Cannot delete faces of visitor %s: %v", visitor.Id, err)
+	}
+}
+
+// enrollVisitor names the visitor: the crops of the visitor become samples of the person,
+// and the visitor is forgotten. Invalid crops are skipped when sample validation is enabled
+func (r *recognizer) enrollVisitor(ctx context.Context, id string, person string) ([]samplestore.Sample, []sampleReport, error) {
+	log := logging.WithContext(ctx)
+	visitor, err := r.visitors.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var contents [][]byte
+	var reports []sampleReport
+	for _, image := range visitor.Images {
+		path, err := r.visitors.ImagePath(id, image)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.configuration.ValidateSamples {
+			report := r.validateSampleBytes(ctx, path, content)
+			reports = append(reports, report)
+			if !report.valid() {
+				log.Warnf("Skipping image %s of visitor %s: %s", image, id, strings.Join(report.Problems, "; "))
+				continue
+			}
+		}
+		contents = append(contents, content)
+	}
+	if len(contents) == 0 {
+		return nil, reports, fmt.Errorf("%w: visitor %s has no valid images", errInvalidSample, id)
+	}
+
+	if err := r.sampleStore.CreatePerson(person); err != nil && !errors.Is(err, samplestore.ErrExists) {
+		return nil, reports, err
+	}
+	samples := make([]samplestore.Sample, 0, len(contents))
+	for _, content := range contents {
+		sample, err := r.sampleStore.AddSample(person, content, ".jpg")
+		if err != nil {
+			return samples, reports, err
+		}
+		samples = append(samples, sample)
+	}
+
+	r.visitorsLock.Lock()
+	removed, err := r.visitors.Remove(id)
+	r.visitorsLock.Unlock()
+	if err != nil {
+		log.Errorf("Cannot forget visitor %s: %v", id, err)
+	} else {
+		r.deleteVisitorFaces(ctx, removed)
+	}
+	log.Infof("Enrolled visitor %s as %s with %d samples", id, person, len(samples))
+	r.reloadAfterChange(ctx)
+	return samples, reports, nil
+}
+
+func (r *recognizer) frequentWindow() time.Duration {
+	return 24 * time.Hour * time.Duration(r.configuration.VisitorsFrequentDays)
+}
+
+func (r *recognizer) visitorResponse(visitor visitors.Visitor, now time.Time) visitorResponse {
+	recent := visitor.VisitsSince(now.Add(-r.frequentWindow()))
+	return visitorResponse{
+		Id:           visitor.Id,
+		FirstSeen:    visitor.FirstSeen(),
+		LastSeen:     visitor.LastSeen(),
+		Visits:       len(visitor.Visits),
+		RecentVisits: recent,
+		Frequent:     recent >= r.configuration.VisitorsFrequentVisits,
+		Faces:        len(visitor.FaceIds),
+		Images:       visitor.Images,
+	}
+}
+
+// ListVisitorsApiHandler lists unknown visitors, the most recently seen first, ?frequent=true lists only frequent ones
+func (r *recognizer) ListVisitorsApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireVisitors(writer) {
+		return
+	}
+	onlyFrequent := request.URL.Query().Get("frequent") == "true"
+	now := time.Now()
+	response := visitorsResponse{Visitors: []visitorResponse{}}
+	for _, visitor := range r.visitors.List() {
+		item := r.visitorResponse(visitor, now)
+		if onlyFrequent && !item.Frequent {
+			continue
+		}
+		response.Visitors = append(response.Visitors, item)
+	}
+	respondWithJSON(writer, http.StatusOK, response)
+}
+
+func (r *recognizer) GetVisitorApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireVisitors(writer) {
+		return
+	}
+	visitor, err := r.visitors.Get(mux.Vars(request)["visitor"])
+	if err != nil {
+		respondWithVisitorError(writer, err)
+		return
+	}
+	respondWithJSON(writer, http.StatusOK, r.visitorResponse(visitor, time.Now()))
+}
+
+func (r *recognizer) GetVisitorImageApiHandler(writer http.ResponseWriter, request *http.Request) {
+	if !r.requireVisitors(writer) {
+		return
+	}
+	vars := mux.Vars(request)
+	path, err := r.visitors.ImagePath(vars["visitor"], vars["image"])
+	if err != nil {
+		respondWithVisitorError(writer, err)
+		return
+	}
+	http.ServeFile(writer, request, path)
+}
+
+func (r *recognizer) DeleteVisitorApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireVisitors(writer) {
+		return
+	}
+	r.visitorsLock.Lock()
+	visitor, err := r.visitors.Remove(mux.Vars(request)["visitor"])
+	r.visitorsLock.Unlock()
+	if err != nil {
+		respondWithVisitorError(writer, err)
+		return
+	}
+	r.deleteVisitorFaces(ctx, visitor)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// EnrollVisitorApiHandler names the visitor, turning it into an enrolled person
+func (r *recognizer) EnrollVisitorApiHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := context.Background()
+	if !r.requireVisitors(writer) || !r.requireSampleStore(writer) {
+		return
+	}
+	var body enrollRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		respondWithError(writer, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	samples, reports, err := r.enrollVisitor(ctx, mux.Vars(request)["visitor"], body.Person)
+	if errors.Is(err, errInvalidSample) {
+		respondWithJSON(writer, http.StatusUnprocessableEntity, enrollVisitorResponse{Samples: []sampleResponse{}, Reports: reports})
+		return
+	}
+	if err != nil {
+		respondWithVisitorError(writer, err)
+		return
+	}
+	response := enrollVisitorResponse{Samples: []sampleResponse{}, Reports: reports}
+	for _, sample := range samples {
+		response.Samples = append(response.Samples, sampleResponse{Sample: sample, Loaded: r.loaded(sample.Path)})
+	}
+	respondWithJSON(writer, http.StatusCreated, response)
+}
+
+func (r *recognizer) requireVisitors(writer http.ResponseWriter) bool {
+	if r.visitors == nil {
+		respondWithError(writer, http.StatusConflict, "visitors are tracked only when the visitors directory is configured")
+		return false
+	}
+	return true
+}
+
+func respondWithVisitorError(writer http.ResponseWriter, err error) {
+	if errors.Is(err, visitors.ErrNotFound) {
+		respondWithError(writer, http.StatusNotFound, err.Error())
+		return
+	}
+	respondWithStoreError(writer, err)
+}